@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sbleks/go-get-imgs/internal/downloader"
+	"github.com/sbleks/go-get-imgs/internal/utils"
+)
+
+// dedupGroup fetches each distinct URL of a run once. The first row with a
+// URL downloads it; later rows with the same normalised URL wait for that
+// download and link to its file.
+type dedupGroup struct {
+	mode downloader.LinkMode
+
+	mu    sync.Mutex
+	calls map[string]*sharedDownload
+}
+
+// sharedDownload is the download of a URL shared by several rows
+type sharedDownload struct {
+	row  int // row that made the download
+	done chan struct{}
+	res  *downloader.Result
+	err  error
+}
+
+// sharedError is the failure of a row whose URL was downloaded for another
+// row, either of that download or of linking to its file
+type sharedError struct {
+	row int
+	err error
+}
+
+func (e *sharedError) Error() string {
+	return fmt.Sprintf("%v (download shared with row %d)", e.err, e.row)
+}
+
+func (e *sharedError) Unwrap() error {
+	return e.err
+}
+
+func newDedupGroup(mode downloader.LinkMode) *dedupGroup {
+	return &dedupGroup{mode: mode, calls: make(map[string]*sharedDownload)}
+}
+
+// download downloads req, or links to the file of an earlier row with the
+// same URL. sharedFrom is that row's number, 0 when req was downloaded or
+// skipped because its file exists.
+func (g *dedupGroup) download(ctx context.Context, dl *downloader.Downloader, req downloader.Request) (res *downloader.Result, sharedFrom int, err error) {
+	key := utils.NormalizeURL(req.URL)
+
+	g.mu.Lock()
+	if s, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		// --skip-existing applies to this row's own file as it would without --dedupe
+		if res, ok := dl.Existing(req); ok {
+			return res, 0, nil
+		}
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return nil, s.row, &sharedError{row: s.row, err: &downloader.DownloadError{Category: downloader.CategoryCanceled, Err: ctx.Err()}}
+		}
+		if s.err != nil {
+			return nil, s.row, &sharedError{row: s.row, err: s.err}
+		}
+		res, err := downloader.Link(req, s.res.Path, g.mode)
+		if err != nil {
+			return nil, s.row, &sharedError{row: s.row, err: err}
+		}
+		res.SHA256 = s.res.SHA256
+		return res, s.row, nil
+	}
+	s := &sharedDownload{row: req.RowNum, done: make(chan struct{})}
+	g.calls[key] = s
+	g.mu.Unlock()
+
+	s.res, s.err = dl.Download(ctx, req)
+	close(s.done)
+	return s.res, 0, s.err
+}
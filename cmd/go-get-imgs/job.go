@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sbleks/go-get-imgs/internal/csv"
+	"github.com/sbleks/go-get-imgs/internal/downloader"
+	"github.com/sbleks/go-get-imgs/internal/naming"
+	"github.com/sbleks/go-get-imgs/internal/report"
+	"github.com/sbleks/go-get-imgs/internal/state"
+	"github.com/sbleks/go-get-imgs/internal/utils"
+)
+
+// job downloads CSV rows and records their outcome in the state file and run report
+type job struct {
+	dl     *downloader.Downloader
+	tmpl   *naming.Template
+	outDir string
+	state  *state.State // nil when progress is not tracked
+	report *report.Report
+	sync   bool        // revalidate completed rows with conditional requests instead of skipping them
+	dedup  *dedupGroup // nil unless rows with the same URL share one download
+
+	checksumColumn int // 1-based index of the expected checksum column, 0 for none
+	checksumAlgo   downloader.ChecksumAlgorithm
+
+	skipped   int64
+	unchanged int64
+	shared    int64
+}
+
+// signalContext returns a context canceled by Ctrl-C or SIGTERM. Cancellation
+// stops dispatching rows and aborts downloads in flight; a second signal kills
+// the process immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// processRow downloads a single row. It is safe for concurrent use.
+func (j *job) processRow(ctx context.Context, row csv.Row) error {
+	url, rowNum := row.URL, row.Num
+	// State and report keep long data: URIs shortened
+	recorded := utils.RecordedURL(url)
+	var cached *downloader.Cached
+	if j.state != nil {
+		if done, ok := j.state.Completed(rowNum, recorded); ok {
+			if !j.sync {
+				atomic.AddInt64(&j.skipped, 1)
+				j.report.Add(report.Row{Row: rowNum, URL: recorded, Status: report.StatusSkipped, Path: done.Path})
+				return nil
+			}
+			if done.ETag != "" || done.LastModified != "" {
+				cached = &downloader.Cached{Path: done.Path, ETag: done.ETag, LastModified: done.LastModified}
+			}
+		}
+	}
+
+	// Validate URL format
+	if !utils.IsValidURL(url) {
+		return j.fail(rowNum, url, 0, downloader.InvalidURLError(url))
+	}
+
+	fmt.Printf("Downloading row %d: %s\n", rowNum, utils.DisplayURL(url))
+	start := time.Now()
+	req := downloader.Request{
+		URL:    url,
+		Dir:    j.outDir,
+		RowNum: rowNum,
+		Filename: func(ext string) (string, error) {
+			return j.tmpl.Render(naming.Data{Row: rowNum, URL: url, Ext: ext, Header: row.Header, Record: row.Record})
+		},
+		Cached: cached,
+	}
+	if j.checksumColumn > 0 && j.checksumColumn <= len(row.Record) {
+		if sum := strings.TrimSpace(row.Record[j.checksumColumn-1]); sum != "" {
+			req.Checksum = &downloader.Checksum{Algorithm: j.checksumAlgo, Hex: sum}
+		}
+	}
+	var res *downloader.Result
+	var err error
+	sharedFrom := 0
+	if j.dedup != nil {
+		res, sharedFrom, err = j.dedup.download(ctx, j.dl, req)
+	} else {
+		res, err = j.dl.Download(ctx, req)
+	}
+	if err != nil {
+		return j.fail(rowNum, url, time.Since(start), err)
+	}
+
+	if res.Skipped {
+		atomic.AddInt64(&j.skipped, 1)
+		if j.state != nil && cached == nil {
+			logStateError(j.state.MarkCompleted(rowNum, recorded, res.Path))
+		}
+		j.report.Add(report.Row{Row: rowNum, URL: recorded, Status: report.StatusSkipped, Path: res.Path})
+		return nil
+	}
+	if res.NotModified {
+		atomic.AddInt64(&j.unchanged, 1)
+	}
+	if sharedFrom != 0 {
+		atomic.AddInt64(&j.shared, 1)
+	}
+
+	if j.state != nil {
+		logStateError(j.state.MarkCompletedWithValidators(rowNum, recorded, res.Path, res.ETag, res.LastModified))
+	}
+	reportRow := report.Row{
+		Row:         rowNum,
+		URL:         recorded,
+		Status:      report.StatusSucceeded,
+		HTTPStatus:  res.StatusCode,
+		ContentType: res.ContentType,
+		Bytes:       res.Bytes,
+		DurationMs:  res.Duration.Milliseconds(),
+		Throughput:  report.Throughput(res.Bytes, res.Duration),
+		Path:        res.Path,
+		SHA256:      res.SHA256,
+		Attempts:    res.Attempts,
+		SharedFrom:  sharedFrom,
+	}
+	if len(res.Redirects) > 0 {
+		reportRow.Redirects = res.Redirects
+		reportRow.FinalURL = res.FinalURL
+	}
+	j.report.Add(reportRow)
+	return nil
+}
+
+// fail records a failed row and returns err for the processor
+func (j *job) fail(rowNum int, url string, elapsed time.Duration, err error) error {
+	if j.state != nil {
+		logStateError(j.state.MarkFailed(rowNum, utils.RecordedURL(url), err))
+	}
+	j.report.Add(failedRow(rowNum, url, elapsed, err))
+	return err
+}
+
+// saveState flushes the state file, if any
+func (j *job) saveState() {
+	if j.state != nil {
+		logStateError(j.state.Save())
+	}
+}
+
+// printSummary prints the outcome of a run and the failed rows
+func (j *job) printSummary(result *csv.ProcessResult) {
+	fmt.Printf("\nDownload Summary:\n")
+	// The processor counts skipped rows as successes; like the report, the
+	// summary lists them on their own
+	fmt.Printf("✅ Successful downloads: %d\n", result.SuccessCount-int(j.skipped))
+	if j.skipped > 0 {
+		fmt.Printf("⏭️  Already downloaded (skipped): %d\n", j.skipped)
+	}
+	if j.unchanged > 0 {
+		fmt.Printf("🔁 Unchanged since last sync: %d\n", j.unchanged)
+	}
+	if j.shared > 0 {
+		fmt.Printf("🔗 Reused the download of another row: %d\n", j.shared)
+	}
+	fmt.Printf("❌ Failed downloads: %d\n", result.ErrorCount)
+	fmt.Printf("📁 Images saved to: %s/\n", j.outDir)
+
+	if len(result.Failures) > 0 {
+		fmt.Printf("\nFailed rows:\n")
+		for _, f := range result.Failures {
+			if f.URL != "" {
+				fmt.Printf("  row %d [%s] %s: %s\n", f.Row, f.Category, f.URL, f.Message)
+			} else {
+				fmt.Printf("  row %d [%s] %s\n", f.Row, f.Category, f.Message)
+			}
+		}
+	}
+}
+
+// writeErrorsFile writes the failed rows to filename when one was requested
+func writeErrorsFile(filename string, result *csv.ProcessResult) {
+	if filename == "" {
+		return
+	}
+	if err := csv.WriteFailures(filename, result.Failures); err != nil {
+		fmt.Printf("Error writing errors file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("📝 Failed rows written to: %s\n", filename)
+}
+
+// writeManifest writes the content store manifest of r to the output
+// directory when the content store is used
+func writeManifest(enabled bool, r *report.Report, outDir string) {
+	if !enabled {
+		return
+	}
+	path := filepath.Join(outDir, report.ManifestFileName)
+	if err := r.WriteManifest(path, outDir); err != nil {
+		fmt.Printf("Error writing manifest: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("🧾 Manifest written to: %s\n", path)
+}
+
+// failedRow builds the report entry for a row whose download failed
+func failedRow(rowNum int, url string, elapsed time.Duration, err error) report.Row {
+	rowErr := csv.NewRowError(rowNum, url, err)
+	row := report.Row{
+		Row:        rowNum,
+		URL:        rowErr.URL,
+		Status:     report.StatusFailed,
+		DurationMs: elapsed.Milliseconds(),
+		Category:   rowErr.Category,
+		Error:      rowErr.Message,
+	}
+
+	var dErr *downloader.DownloadError
+	if errors.As(err, &dErr) {
+		row.HTTPStatus = dErr.StatusCode
+		row.Attempts = dErr.Attempts
+		row.Redirects = dErr.Redirects
+	}
+	var shared *sharedError
+	if errors.As(err, &shared) {
+		row.SharedFrom = shared.row
+	}
+
+	return row
+}
+
+// logStateError reports a failure to persist the job state without aborting the run
+func logStateError(err error) {
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
-	"time"
 
 	"github.com/sbleks/go-get-imgs/internal/csv"
-	"github.com/sbleks/go-get-imgs/internal/downloader"
-	"github.com/sbleks/go-get-imgs/internal/utils"
+	"github.com/sbleks/go-get-imgs/internal/naming"
+	"github.com/sbleks/go-get-imgs/internal/report"
+	"github.com/sbleks/go-get-imgs/internal/state"
 )
 
 // Version information for cross-platform builds
@@ -18,18 +20,101 @@ var (
 	GitCommit = "unknown"
 )
 
+func usage() {
+	fmt.Println("Usage: go-get-imgs [options] <csv-file> [url-column-index]")
+	fmt.Println("Example: go-get-imgs data.csv 3")
+	fmt.Println("Example: go-get-imgs --column image_url --workers 8 data.csv")
+	fmt.Println("       go-get-imgs retry [options] <report-file>")
+	fmt.Println()
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+	fmt.Printf("Version: %s (Built: %s, Commit: %s)\n", Version, BuildTime, GitCommit)
+}
+
+// openState prepares the job state file. A fresh state is started unless
+// resume is set and a state recorded for the same CSV content and column
+// exists, or sync is set and a state recorded for the same column exists. A
+// synced state is carried over to the current CSV content, keeping the
+// validators of rows whose URL is unchanged.
+func openState(path, csvFile, column string, resume, sync bool) (*state.State, error) {
+	csvHash, err := state.HashFile(csvFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if resume || sync {
+		st, err := state.Load(path)
+		switch {
+		case err == nil && sync:
+			if st.Column == column {
+				st.CSVPath, st.CSVSHA256 = csvFile, csvHash
+				return st, st.Save()
+			}
+			fmt.Printf("State at %s was recorded for column %q, syncing from scratch\n", path, st.Column)
+		case err == nil:
+			if err := st.Matches(csvHash, column); err != nil {
+				return nil, fmt.Errorf("cannot resume: %v; rerun without --resume to start over", err)
+			}
+			return st, nil
+		case os.IsNotExist(err):
+			fmt.Printf("No state file found at %s, starting from the beginning\n", path)
+		default:
+			return nil, err
+		}
+	}
+
+	st := state.New(path, csvFile, csvHash, column)
+	return st, st.Save()
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: go-get-imgs <csv-file> <url-column-index>")
-		fmt.Println("Example: go-get-imgs data.csv 3")
-		fmt.Printf("Version: %s (Built: %s, Commit: %s)\n", Version, BuildTime, GitCommit)
+	if len(os.Args) > 1 && os.Args[1] == "retry" {
+		runRetry(os.Args[2:])
+		return
+	}
+
+	column := flag.String("column", "", "URL column `name` from the CSV header (case-insensitive) or 1-based index")
+	outDir := flag.String("out", "downloads", "`directory` images are saved to")
+	nameTemplate := flag.String("name-template", naming.DefaultTemplate, "file name `template`; placeholders: {row}, {row:05d}, {col:NAME}, {col:N}, {urlbase}, {urlhash}, {urlhash:N}, {ext}")
+	reportFile := flag.String("report", "", "write a JSON run report to this `file`")
+	resume := flag.Bool("resume", false, "skip rows completed by a previous run of the same CSV and retry the rest")
+	syncMode := flag.Bool("sync", false, "re-fetch completed rows with conditional requests, keeping files the server reports unchanged")
+	opts := registerDownloadFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
 		os.Exit(1)
 	}
 
-	csvFile := os.Args[1]
-	urlColumnIndex, err := strconv.Atoi(os.Args[2])
-	if err != nil {
-		fmt.Printf("Error: Invalid URL column index: %v\n", err)
+	if err := opts.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *resume && *syncMode {
+		fmt.Println("Error: --resume and --sync cannot be combined")
+		os.Exit(1)
+	}
+
+	csvFile := flag.Arg(0)
+	urlColumn := *column
+	switch {
+	case flag.NArg() == 2 && urlColumn != "":
+		fmt.Println("Error: Specify the URL column either with --column or as a positional index, not both")
+		os.Exit(1)
+	case flag.NArg() == 2:
+		index, err := strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			fmt.Printf("Error: Invalid URL column index: %v\n", err)
+			os.Exit(1)
+		}
+		// The positional form is always an index, even where a header is
+		// named like a number
+		urlColumn = csv.IndexColumn(index)
+	case urlColumn == "":
+		fmt.Println("Error: Missing URL column; pass --column NAME or a column index")
 		os.Exit(1)
 	}
 
@@ -38,35 +123,104 @@ func main() {
 		os.Exit(1)
 	}
 
+	tmpl, err := loadTemplate(*nameTemplate, csvFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	checksumColumn, checksumAlgo, err := opts.checksums(csvFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Create downloads directory
-	downloadsDir := "downloads"
+	downloadsDir := *outDir
 	if err := os.MkdirAll(downloadsDir, 0755); err != nil {
 		fmt.Printf("Error creating downloads directory: %v\n", err)
 		os.Exit(1)
 	}
 
+	statePath := filepath.Join(downloadsDir, state.FileName)
+	jobState, err := openState(statePath, csvFile, urlColumn, *resume, *syncMode)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Initialize components
-	processor := csv.NewProcessor()
-	downloader := downloader.NewDownloader(30 * time.Second)
+	dl, err := opts.newDownloader()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	processor := csv.NewProcessor(csv.WithWorkers(opts.workers))
+	j := &job{
+		dl:     dl,
+		tmpl:   tmpl,
+		outDir: downloadsDir,
+		state:  jobState,
+		report: report.New(Version, csvFile, urlColumn, downloadsDir, tmpl.String()),
+		sync:   *syncMode,
+		dedup:  opts.newDedupGroup(),
+
+		checksumColumn: checksumColumn,
+		checksumAlgo:   checksumAlgo,
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
 
 	// Process CSV file
-	result, err := processor.ProcessCSV(csvFile, urlColumnIndex, func(url string, rowNum int) error {
-		// Validate URL format
-		if !utils.IsValidURL(url) {
-			return fmt.Errorf("invalid URL format: %s", url)
-		}
+	result, err := processor.ProcessRows(ctx, csvFile, urlColumn, j.processRow)
+
+	j.saveState()
 
-		fmt.Printf("Downloading row %d: %s\n", rowNum, url)
-		return downloader.DownloadImage(url, downloadsDir, rowNum)
-	})
+	if err == nil {
+		j.report.Finish(result)
+		if *reportFile != "" {
+			if err := j.report.Write(*reportFile); err != nil {
+				fmt.Printf("Error writing report: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
 
 	if err != nil {
 		fmt.Printf("Error processing CSV file: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("\nDownload Summary:\n")
-	fmt.Printf("✅ Successful downloads: %d\n", result.SuccessCount)
-	fmt.Printf("❌ Failed downloads: %d\n", result.ErrorCount)
-	fmt.Printf("📁 Images saved to: %s/\n", downloadsDir)
+	j.printSummary(result)
+	writeErrorsFile(opts.errorsFile, result)
+
+	if *reportFile != "" {
+		fmt.Printf("📊 Run report written to: %s\n", *reportFile)
+	}
+	writeManifest(opts.contentStore != "", j.report, downloadsDir)
+
+	if result.Canceled {
+		fmt.Println("\n⚠️  Run interrupted before all rows were processed; rerun with --resume to continue")
+		os.Exit(130)
+	}
+}
+
+// loadTemplate parses a file name template and checks its column references
+// against the header of csvFile
+func loadTemplate(text, csvFile string) (*naming.Template, error) {
+	tmpl, err := naming.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := csv.ReadHeader(csvFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Validate(header); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
 }
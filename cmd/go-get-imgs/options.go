@@ -0,0 +1,547 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbleks/go-get-imgs/internal/csv"
+	"github.com/sbleks/go-get-imgs/internal/downloader"
+	"github.com/sbleks/go-get-imgs/internal/utils"
+)
+
+// downloadOptions holds the flags shared by every command that downloads images
+type downloadOptions struct {
+	workers        int
+	rejectNonImage bool
+	skipExisting   bool
+	errorsFile     string
+	maxAttempts    int
+	retryBase      time.Duration
+	retryMax       time.Duration
+	retryJitter    float64
+	rps            float64
+	hostRPS        float64
+	hostConns      int
+	maxBandwidth   byteSizeFlag
+	hostLimits     hostLimitsFlag
+	userAgent      string
+	headers        headerFlag
+	basicAuth      string
+	bearerAuth     string
+	authHosts      hostsFlag
+	cookieFile     string
+	headerRules    string
+	proxy          string
+	proxyAuth      string
+	caCert         string
+	clientCert     string
+	clientKey      string
+	insecure       bool
+	fileRoot       string
+	maxDataURISize byteSizeFlag
+	maxSize        byteSizeFlag
+	minSize        byteSizeFlag
+	safeMode       bool
+	allow          allowFlag
+	maxRedirects   int
+	sameHost       bool
+	noDowngrade    bool
+	placeholders   patternFlag
+	dedupe         string
+	contentStore   string
+	checksumColumn string
+	checksumAlgo   string
+}
+
+// registerDownloadFlags defines the shared download flags on fs
+func registerDownloadFlags(fs *flag.FlagSet) *downloadOptions {
+	retryDefaults := downloader.DefaultRetryPolicy()
+	o := &downloadOptions{}
+
+	fs.IntVar(&o.workers, "workers", 4, "number of concurrent downloads")
+	fs.BoolVar(&o.rejectNonImage, "reject-non-image", false, "fail rows whose response body is not a recognised image format")
+	fs.Var(&o.maxSize, "max-size", "fail images larger than `size`, such as 50MB (0 for no limit)")
+	fs.Var(&o.minSize, "min-size", "fail images smaller than `size`, such as 1KB, to catch placeholders (0 for no limit)")
+	fs.StringVar(&o.dedupe, "dedupe", "", "download each distinct URL once and give rows repeating it a `MODE` of hardlink, symlink or copy")
+	fs.StringVar(&o.contentStore, "content-store", "", "store each distinct image once under objects/ by SHA-256, linking file names to it with `MODE` hardlink, symlink or copy, and write manifest.csv")
+	fs.StringVar(&o.checksumColumn, "checksum-column", "", "verify each image against the hex checksum in this CSV `column` (name or 1-based index); empty cells are not checked")
+	fs.StringVar(&o.checksumAlgo, "checksum-algo", string(downloader.ChecksumSHA256), "checksum `algorithm` of --checksum-column: md5, sha1 or sha256")
+	fs.BoolVar(&o.skipExisting, "skip-existing", false, "skip rows whose target file already exists")
+	fs.StringVar(&o.errorsFile, "errors-file", "", "write failed rows to this CSV `file`")
+	fs.IntVar(&o.maxAttempts, "max-attempts", retryDefaults.MaxAttempts, "maximum attempts per download, including the first")
+	fs.DurationVar(&o.retryBase, "retry-base", retryDefaults.BaseDelay, "initial delay between retries, doubled on each retry")
+	fs.DurationVar(&o.retryMax, "retry-max", retryDefaults.MaxDelay, "maximum delay between retries, including Retry-After")
+	fs.Float64Var(&o.retryJitter, "retry-jitter", retryDefaults.Jitter, "fraction of each retry delay that is randomised (0-1)")
+	fs.Float64Var(&o.rps, "rps", 0, "maximum requests per second across all hosts (0 for no limit)")
+	fs.Float64Var(&o.hostRPS, "host-rps", 0, "maximum requests per second to each host (0 for no limit)")
+	fs.IntVar(&o.hostConns, "host-connections", 0, "maximum concurrent requests to each host (0 for no limit)")
+	fs.Var(&o.maxBandwidth, "max-bandwidth", "maximum download `rate` shared by all workers, such as 5MB/s or 512KiB/s (0 for no limit)")
+	fs.StringVar(&o.userAgent, "user-agent", "go-get-imgs/"+Version, "User-Agent `string` sent with every request")
+	fs.Var(&o.headers, "header", "extra request header as `NAME:VALUE`; repeatable")
+	fs.StringVar(&o.basicAuth, "auth-basic", "", "send Basic credentials read as USER:PASSWORD from `SOURCE`, either env:VAR or file:PATH")
+	fs.StringVar(&o.bearerAuth, "auth-bearer", "", "send a Bearer token read from `SOURCE`, either env:VAR or file:PATH")
+	fs.Var(&o.authHosts, "auth-host", "send --auth-basic or --auth-bearer credentials to this host name or *.domain `pattern` (required with them); repeatable")
+	fs.StringVar(&o.cookieFile, "cookies", "", "send cookies from this Netscape cookie `file`")
+	fs.StringVar(&o.headerRules, "header-rules", "", "JSON `file` mapping host names or *.domain patterns to extra request headers")
+	fs.StringVar(&o.proxy, "proxy", "", "send requests through this proxy `URL` instead of the one from HTTP(S)_PROXY")
+	fs.StringVar(&o.proxyAuth, "proxy-auth", "", "proxy credentials read as USER:PASSWORD from `SOURCE`, either env:VAR or file:PATH")
+	fs.StringVar(&o.caCert, "ca-cert", "", "PEM `file` of CA certificates to trust in addition to the system ones")
+	fs.StringVar(&o.clientCert, "client-cert", "", "PEM client certificate `file` for mutual TLS")
+	fs.StringVar(&o.clientKey, "client-key", "", "PEM private key `file` for --client-cert")
+	fs.BoolVar(&o.insecure, "insecure-skip-verify", false, "do not verify server TLS certificates (dangerous)")
+	fs.StringVar(&o.fileRoot, "file-root", "", "allow file:// URLs inside this `directory`; they are rejected otherwise")
+	o.maxDataURISize = downloader.DefaultMaxDataURISize
+	fs.Var(&o.maxDataURISize, "max-data-uri-size", "largest decoded `size` of a data: URI, such as 10MiB")
+	fs.IntVar(&o.maxRedirects, "max-redirects", downloader.DefaultRedirectPolicy().MaxRedirects, "maximum redirects followed per request (0 to follow none)")
+	fs.BoolVar(&o.sameHost, "same-host-redirects", false, "fail rows redirected to a different host")
+	fs.BoolVar(&o.noDowngrade, "no-https-downgrade", false, "fail rows redirected from https to http")
+	fs.Var(&o.placeholders, "placeholder-pattern", "fail rows redirected to a URL matching this `regexp`, such as /no-image; repeatable")
+	fs.BoolVar(&o.safeMode, "safe-mode", false, "refuse connections to loopback, private, link-local and other internal addresses")
+	fs.Var(&o.allow, "allow-host", "exempt a `HOST`, *.domain, IP address or CIDR range from --safe-mode; repeatable")
+	fs.Var(&o.hostLimits, "host-limit", "per-host limits as `HOST:rps=N,connections=N,bandwidth=RATE`, overriding --host-rps and --host-connections; repeatable")
+
+	return o
+}
+
+// validate checks option values that flag parsing cannot
+func (o *downloadOptions) validate() error {
+	if o.workers < 1 {
+		return fmt.Errorf("--workers must be at least 1, got %d", o.workers)
+	}
+	if o.dedupe != "" {
+		if _, err := downloader.ParseLinkMode(o.dedupe); err != nil {
+			return fmt.Errorf("--dedupe: %v", err)
+		}
+	}
+	if o.contentStore != "" {
+		if _, err := downloader.ParseLinkMode(o.contentStore); err != nil {
+			return fmt.Errorf("--content-store: %v", err)
+		}
+	}
+	if _, err := downloader.ParseChecksumAlgorithm(o.checksumAlgo); err != nil {
+		return fmt.Errorf("--checksum-algo: %v", err)
+	}
+	if o.maxRedirects < 0 {
+		return fmt.Errorf("--max-redirects must not be negative, got %d", o.maxRedirects)
+	}
+	if o.rps < 0 || o.hostRPS < 0 || o.hostConns < 0 {
+		return fmt.Errorf("--rps, --host-rps and --host-connections must not be negative")
+	}
+	if o.maxSize > 0 && o.minSize > o.maxSize {
+		return fmt.Errorf("--min-size must not exceed --max-size")
+	}
+	if o.basicAuth != "" && o.bearerAuth != "" {
+		return fmt.Errorf("--auth-basic and --auth-bearer cannot be combined")
+	}
+	if len(o.authHosts) > 0 && o.basicAuth == "" && o.bearerAuth == "" {
+		return fmt.Errorf("--auth-host requires --auth-basic or --auth-bearer")
+	}
+	if (o.basicAuth != "" || o.bearerAuth != "") && len(o.authHosts) == 0 {
+		return fmt.Errorf("--auth-basic and --auth-bearer require --auth-host to name the hosts credentials are sent to")
+	}
+	if o.proxyAuth != "" && o.proxy == "" {
+		return fmt.Errorf("--proxy-auth requires --proxy")
+	}
+	if (o.clientCert == "") != (o.clientKey == "") {
+		return fmt.Errorf("--client-cert and --client-key must be given together")
+	}
+	if len(o.allow.policy.AllowHosts)+len(o.allow.policy.AllowNets) > 0 && !o.safeMode {
+		return fmt.Errorf("--allow-host requires --safe-mode")
+	}
+	return nil
+}
+
+// newDownloader builds a Downloader configured from the options, reading the
+// credentials, cookie and header rule files they refer to
+func (o *downloadOptions) newDownloader() (*downloader.Downloader, error) {
+	opts := []downloader.Option{
+		downloader.WithRetryPolicy(downloader.RetryPolicy{
+			MaxAttempts: o.maxAttempts,
+			BaseDelay:   o.retryBase,
+			MaxDelay:    o.retryMax,
+			Jitter:      o.retryJitter,
+		}),
+		downloader.WithRejectNonImage(o.rejectNonImage),
+		downloader.WithSkipExisting(o.skipExisting),
+		downloader.WithLimits(downloader.Limits{
+			RPS:       o.rps,
+			Bandwidth: int64(o.maxBandwidth),
+			Host:      downloader.HostLimits{RPS: o.hostRPS, MaxConns: o.hostConns},
+			Hosts:     o.hostLimits.limits(o.hostRPS, o.hostConns),
+		}),
+		downloader.WithUserAgent(o.userAgent),
+		downloader.WithHeaders(http.Header(o.headers)),
+		downloader.WithFileRoot(o.fileRoot),
+		downloader.WithMaxDataURISize(int64(o.maxDataURISize)),
+		downloader.WithMaxSize(int64(o.maxSize)),
+		downloader.WithMinSize(int64(o.minSize)),
+		downloader.WithRedirectPolicy(downloader.RedirectPolicy{
+			MaxRedirects: o.maxRedirects,
+			SameHost:     o.sameHost,
+			NoDowngrade:  o.noDowngrade,
+			Placeholders: o.placeholders,
+		}),
+	}
+
+	switch {
+	case o.basicAuth != "":
+		credentials, err := readSecret(o.basicAuth)
+		if err != nil {
+			return nil, fmt.Errorf("--auth-basic: %v", err)
+		}
+		username, password, ok := strings.Cut(credentials, ":")
+		if !ok {
+			return nil, fmt.Errorf("--auth-basic: expected USER:PASSWORD from %s", o.basicAuth)
+		}
+		opts = append(opts, downloader.WithBasicAuth(username, password))
+	case o.bearerAuth != "":
+		token, err := readSecret(o.bearerAuth)
+		if err != nil {
+			return nil, fmt.Errorf("--auth-bearer: %v", err)
+		}
+		opts = append(opts, downloader.WithBearerToken(token))
+	}
+	if len(o.authHosts) > 0 {
+		opts = append(opts, downloader.WithAuthHosts(o.authHosts))
+	}
+
+	if o.cookieFile != "" {
+		jar, err := downloader.LoadCookieFile(o.cookieFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithCookieJar(jar))
+	}
+
+	if o.headerRules != "" {
+		rules, err := downloader.LoadHeaderRules(o.headerRules)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithHostHeaders(rules))
+	}
+
+	if o.proxy != "" || o.caCert != "" || o.clientCert != "" || o.insecure {
+		transport, err := o.newTransport()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, downloader.WithTransport(transport))
+	}
+
+	if o.safeMode {
+		policy := o.allow.policy
+		policy.TrustProxy = o.proxy != ""
+		opts = append(opts, downloader.WithSafeMode(policy))
+	}
+
+	if o.contentStore != "" {
+		mode, _ := downloader.ParseLinkMode(o.contentStore)
+		opts = append(opts, downloader.WithContentStore(mode))
+	}
+
+	return downloader.NewDownloader(30*time.Second, opts...), nil
+}
+
+// newDedupGroup returns the group sharing downloads between rows with the same
+// URL, or nil without --dedupe. The mode has been checked by validate.
+func (o *downloadOptions) newDedupGroup() *dedupGroup {
+	if o.dedupe == "" {
+		return nil
+	}
+	mode, _ := downloader.ParseLinkMode(o.dedupe)
+	return newDedupGroup(mode)
+}
+
+// checksums returns the 1-based index of --checksum-column in the header of
+// csvFile, 0 without the flag, and the algorithm of its checksums
+func (o *downloadOptions) checksums(csvFile string) (int, downloader.ChecksumAlgorithm, error) {
+	algo, _ := downloader.ParseChecksumAlgorithm(o.checksumAlgo)
+	if o.checksumColumn == "" {
+		return 0, algo, nil
+	}
+	header, err := csv.ReadHeader(csvFile)
+	if err != nil {
+		return 0, "", err
+	}
+	index, err := csv.ResolveColumn(header, o.checksumColumn)
+	if err != nil {
+		return 0, "", fmt.Errorf("--checksum-column: %v", err)
+	}
+	return index, algo, nil
+}
+
+// newTransport builds the HTTP transport for the proxy and TLS options
+func (o *downloadOptions) newTransport() (*http.Transport, error) {
+	proxy := o.proxy
+	if o.proxyAuth != "" {
+		credentials, err := readSecret(o.proxyAuth)
+		if err != nil {
+			return nil, fmt.Errorf("--proxy-auth: %v", err)
+		}
+		username, password, ok := strings.Cut(credentials, ":")
+		if !ok {
+			return nil, fmt.Errorf("--proxy-auth: expected USER:PASSWORD from %s", o.proxyAuth)
+		}
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		proxyURL.User = url.UserPassword(username, password)
+		proxy = proxyURL.String()
+	}
+
+	if o.insecure {
+		fmt.Println("⚠️  WARNING: --insecure-skip-verify disables TLS certificate verification.")
+		fmt.Println("⚠️  Any server, or anyone on the network path, can impersonate the image hosts.")
+	}
+
+	return downloader.NewTransport(downloader.TransportOptions{
+		Proxy:              proxy,
+		CACertFile:         o.caCert,
+		ClientCertFile:     o.clientCert,
+		ClientKeyFile:      o.clientKey,
+		InsecureSkipVerify: o.insecure,
+	})
+}
+
+// readSecret reads a credential from env:VAR or file:PATH so it never has to
+// appear on the command line. Surrounding whitespace, such as the trailing
+// newline of a file, is dropped.
+func readSecret(source string) (string, error) {
+	kind, name, _ := strings.Cut(source, ":")
+	var secret string
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		secret = value
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %v", err)
+		}
+		secret = string(data)
+	default:
+		return "", fmt.Errorf("expected env:VAR or file:PATH, got %q", source)
+	}
+
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", source)
+	}
+	return secret, nil
+}
+
+// headerFlag collects repeated --header values
+type headerFlag http.Header
+
+func (f *headerFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for name := range *f {
+		parts = append(parts, name)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// Set parses NAME:VALUE
+func (f *headerFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("expected NAME:VALUE, got %q", value)
+	}
+	if *f == nil {
+		*f = make(headerFlag)
+	}
+	http.Header(*f).Add(name, strings.TrimSpace(val))
+	return nil
+}
+
+// allowFlag collects repeated --allow-host values
+type allowFlag struct {
+	values []string
+	policy downloader.NetworkPolicy
+}
+
+func (f *allowFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, " ")
+}
+
+// Set parses a CIDR range, an IP address or a host name pattern
+func (f *allowFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		f.policy.AllowNets = append(f.policy.AllowNets, prefix.Masked())
+	} else if addr, err := netip.ParseAddr(value); err == nil {
+		f.policy.AllowNets = append(f.policy.AllowNets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	} else if value == "" || strings.ContainsAny(value, "/: \t") {
+		return fmt.Errorf("expected a host name, *.domain, IP address or CIDR range, got %q", value)
+	} else {
+		f.policy.AllowHosts = append(f.policy.AllowHosts, value)
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+// hostsFlag collects repeated host name or *.domain pattern values
+type hostsFlag []string
+
+func (f *hostsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, " ")
+}
+
+func (f *hostsFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ContainsAny(value, "/: \t") {
+		return fmt.Errorf("expected a host name or *.domain, got %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// patternFlag collects repeated regular expression values
+type patternFlag []*regexp.Regexp
+
+func (f *patternFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, re := range *f {
+		parts = append(parts, re.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *patternFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, re)
+	return nil
+}
+
+// hostLimitsFlag collects repeated --host-limit values
+type hostLimitsFlag []hostLimit
+
+// hostLimit is a single --host-limit value. Unset rps and conns are -1 and
+// fall back to --host-rps and --host-connections; an unset bandwidth is 0.
+type hostLimit struct {
+	host      string
+	rps       float64
+	conns     int
+	bandwidth int64
+}
+
+func (f *hostLimitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, hl := range *f {
+		parts = append(parts, hl.host)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set parses HOST:rps=N,connections=N,bandwidth=RATE; any setting may be omitted
+func (f *hostLimitsFlag) Set(value string) error {
+	host, settings, ok := strings.Cut(value, ":")
+	host = strings.TrimSpace(host)
+	if !ok || host == "" || strings.TrimSpace(settings) == "" {
+		return fmt.Errorf("expected HOST:rps=N,connections=N,bandwidth=RATE, got %q", value)
+	}
+
+	hl := hostLimit{host: host, rps: -1, conns: -1}
+	for _, setting := range strings.Split(settings, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		switch key {
+		case "rps":
+			rps, err := strconv.ParseFloat(val, 64)
+			if err != nil || rps < 0 {
+				return fmt.Errorf("invalid rps %q for host %s", val, host)
+			}
+			hl.rps = rps
+		case "connections":
+			conns, err := strconv.Atoi(val)
+			if err != nil || conns < 0 {
+				return fmt.Errorf("invalid connections %q for host %s", val, host)
+			}
+			hl.conns = conns
+		case "bandwidth":
+			bandwidth, err := utils.ParseByteSize(val)
+			if err != nil {
+				return fmt.Errorf("invalid bandwidth for host %s: %v", host, err)
+			}
+			hl.bandwidth = bandwidth
+		default:
+			return fmt.Errorf("unknown setting %q for host %s; expected rps, connections or bandwidth", key, host)
+		}
+	}
+
+	*f = append(*f, hl)
+	return nil
+}
+
+// limits returns the per-host overrides, filling unset fields from the defaults
+func (f hostLimitsFlag) limits(defaultRPS float64, defaultConns int) map[string]downloader.HostLimits {
+	if len(f) == 0 {
+		return nil
+	}
+
+	limits := make(map[string]downloader.HostLimits, len(f))
+	for _, hl := range f {
+		l := downloader.HostLimits{RPS: hl.rps, MaxConns: hl.conns, Bandwidth: hl.bandwidth}
+		if hl.rps < 0 {
+			l.RPS = defaultRPS
+		}
+		if hl.conns < 0 {
+			l.MaxConns = defaultConns
+		}
+		limits[hl.host] = l
+	}
+	return limits
+}
+
+// byteSizeFlag is a flag holding a number of bytes, given with an optional
+// unit such as 5MB or 512KiB
+type byteSizeFlag int64
+
+func (f *byteSizeFlag) String() string {
+	if f == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*f), 10)
+}
+
+func (f *byteSizeFlag) Set(value string) error {
+	n, err := utils.ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*f = byteSizeFlag(n)
+	return nil
+}
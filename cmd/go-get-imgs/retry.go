@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sbleks/go-get-imgs/internal/csv"
+	"github.com/sbleks/go-get-imgs/internal/report"
+	"github.com/sbleks/go-get-imgs/internal/state"
+	"github.com/sbleks/go-get-imgs/internal/utils"
+)
+
+// CategoryURLChanged marks a row whose URL in the CSV no longer matches the
+// URL recorded in the report being retried
+const CategoryURLChanged = "url-changed"
+
+// urlChangedError reports that a retried row's URL differs from the report
+type urlChangedError struct {
+	recorded string
+	current  string
+}
+
+func (e *urlChangedError) Error() string {
+	return fmt.Sprintf("URL changed since the report was written (was %s, now %s)", e.recorded, e.current)
+}
+
+// FailureCategory implements the csv package's failure categorisation
+func (e *urlChangedError) FailureCategory() string {
+	return CategoryURLChanged
+}
+
+// runRetry implements "go-get-imgs retry": it re-attempts the rows a previous
+// run's report marks as failed, keeping their original row numbers and output
+// paths, and merges the new outcomes back into the report
+func runRetry(args []string) {
+	fs := flag.NewFlagSet("retry", flag.ExitOnError)
+	csvOverride := fs.String("csv", "", "read rows from this CSV `file` instead of the one recorded in the report")
+	outFile := fs.String("report-out", "", "write the merged report to this `file` instead of updating the report in place")
+	opts := registerDownloadFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go-get-imgs retry [options] <report-file>")
+		fmt.Println("Example: go-get-imgs retry --workers 8 report.json")
+		fmt.Println()
+		fmt.Println("Options:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := opts.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	reportFile := fs.Arg(0)
+	prev, err := report.Load(reportFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	csvFile := prev.CSVPath
+	if *csvOverride != "" {
+		csvFile = *csvOverride
+	}
+	if _, err := os.Stat(csvFile); os.IsNotExist(err) {
+		fmt.Printf("Error: CSV file '%s' does not exist; pass --csv to point at it\n", csvFile)
+		os.Exit(1)
+	}
+
+	failed := prev.FailedRows()
+	if len(failed) == 0 {
+		fmt.Printf("No failed rows in %s, nothing to retry\n", reportFile)
+		return
+	}
+
+	tmpl, err := loadTemplate(prev.NameTemplate, csvFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	checksumColumn, checksumAlgo, err := opts.checksums(csvFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(prev.OutDir, 0755); err != nil {
+		fmt.Printf("Error creating downloads directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	recorded := make(map[int]string, len(prev.Rows))
+	for _, row := range prev.Rows {
+		recorded[row.Row] = row.URL
+	}
+
+	dl, err := opts.newDownloader()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	j := &job{
+		dl:     dl,
+		tmpl:   tmpl,
+		outDir: prev.OutDir,
+		state:  retryState(filepath.Join(prev.OutDir, state.FileName), csvFile, prev.Column),
+		report: report.New(Version, csvFile, prev.Column, prev.OutDir, tmpl.String()),
+		dedup:  opts.newDedupGroup(),
+
+		checksumColumn: checksumColumn,
+		checksumAlgo:   checksumAlgo,
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	fmt.Printf("Retrying %d failed row(s) from %s\n", len(failed), reportFile)
+	processor := csv.NewProcessor(csv.WithWorkers(opts.workers), csv.WithRows(failed))
+	result, err := processor.ProcessRows(ctx, csvFile, prev.Column, func(ctx context.Context, row csv.Row) error {
+		// Reports keep long data: URIs shortened, so the CSV's URL is compared in that form
+		if url, current := recorded[row.Num], utils.RecordedURL(row.URL); url != "" && url != current {
+			return j.fail(row.Num, row.URL, 0, &urlChangedError{recorded: url, current: current})
+		}
+		return j.processRow(ctx, row)
+	})
+
+	j.saveState()
+
+	if err != nil {
+		fmt.Printf("Error processing CSV file: %v\n", err)
+		os.Exit(1)
+	}
+
+	j.report.Finish(result)
+	prev.Merge(j.report)
+	if *outFile == "" {
+		*outFile = reportFile
+	}
+	if err := prev.Write(*outFile); err != nil {
+		fmt.Printf("Error writing report: %v\n", err)
+		os.Exit(1)
+	}
+
+	j.printSummary(result)
+	writeErrorsFile(opts.errorsFile, result)
+	fmt.Printf("📊 Merged report written to: %s\n", *outFile)
+	writeManifest(opts.contentStore != "", prev, prev.OutDir)
+
+	if result.Canceled {
+		fmt.Println("\n⚠️  Retry interrupted before all rows were processed; rerun the retry to continue")
+		os.Exit(130)
+	}
+}
+
+// retryState returns the job state recorded for the same CSV content and
+// column, or nil when there is none, so a retry keeps it up to date without
+// requiring one
+func retryState(path, csvFile, column string) *state.State {
+	st, err := state.Load(path)
+	if err != nil {
+		return nil
+	}
+
+	csvHash, err := state.HashFile(csvFile)
+	if err != nil || st.Matches(csvHash, column) != nil {
+		return nil
+	}
+
+	return st
+}
@@ -1,18 +1,55 @@
 package csv
 
 import (
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/sbleks/go-get-imgs/internal/utils"
 )
 
 // Processor handles CSV file processing operations
-type Processor struct{}
+type Processor struct {
+	workers int
+	rows    map[int]bool
+}
+
+// Option configures a Processor
+type Option func(*Processor)
+
+// WithWorkers sets how many rows are handed to the download callback concurrently
+func WithWorkers(n int) Option {
+	return func(p *Processor) {
+		if n > 0 {
+			p.workers = n
+		}
+	}
+}
+
+// WithRows restricts processing to the given data row numbers. Other rows are
+// read but neither dispatched nor counted, so row numbers keep matching the file.
+func WithRows(rows []int) Option {
+	return func(p *Processor) {
+		p.rows = make(map[int]bool, len(rows))
+		for _, n := range rows {
+			p.rows[n] = true
+		}
+	}
+}
 
 // NewProcessor creates a new CSV processor instance
-func NewProcessor() *Processor {
-	return &Processor{}
+func NewProcessor(opts ...Option) *Processor {
+	p := &Processor{workers: 1}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // ProcessResult contains the results of CSV processing
@@ -20,10 +57,143 @@ type ProcessResult struct {
 	SuccessCount int
 	ErrorCount   int
 	TotalRows    int
+	Failures     []RowError // one entry per failed row, ordered by row number
+	Canceled     bool       // processing stopped early because the context was canceled
 }
 
-// ProcessCSV processes a CSV file and returns processing results
+// Failure categories assigned by the processor itself. Errors returned by the
+// download callback carry their own category when they implement
+// FailureCategory() string, and fall back to CategoryDownload otherwise.
+const (
+	CategoryShortRow  = "short-row"
+	CategoryEmptyCell = "empty-cell"
+	CategoryDownload  = "download"
+)
+
+// RowError describes why a single row failed
+type RowError struct {
+	Row      int
+	URL      string
+	Category string
+	Message  string
+}
+
+// NewRowError builds the RowError for a failed download callback. Long data:
+// URIs are kept in the shortened form of utils.RecordedURL.
+func NewRowError(rowNum int, url string, err error) RowError {
+	category := CategoryDownload
+	var categorized interface{ FailureCategory() string }
+	if errors.As(err, &categorized) && categorized.FailureCategory() != "" {
+		category = categorized.FailureCategory()
+	}
+	return RowError{Row: rowNum, URL: utils.RecordedURL(url), Category: category, Message: err.Error()}
+}
+
+// Row is a CSV data row handed to the download callback
+type Row struct {
+	Num    int      // 1-based data row number, not counting the header
+	URL    string   // trimmed value of the URL column
+	Header []string // CSV header shared by all rows
+	Record []string // all fields of the row
+}
+
+// ResolveColumn returns the 1-based index of column within header.
+// Header names are matched case-insensitively; when no name matches and column
+// is a positive number it is used as a 1-based index instead. A column of the
+// form #N is always the 1-based index N, even when a header is named N.
+func ResolveColumn(header []string, column string) (int, error) {
+	name := strings.TrimSpace(column)
+	if name == "" {
+		return 0, fmt.Errorf("column must not be empty")
+	}
+
+	if position, ok := strings.CutPrefix(name, "#"); ok {
+		index, err := strconv.Atoi(position)
+		if err != nil {
+			return 0, fmt.Errorf("invalid column index %q", position)
+		}
+		return columnIndex(header, index)
+	}
+
+	for i, h := range header {
+		if strings.EqualFold(normalizeHeader(h, i), name) {
+			return i + 1, nil
+		}
+	}
+
+	if index, err := strconv.Atoi(name); err == nil {
+		return columnIndex(header, index)
+	}
+
+	available := make([]string, len(header))
+	for i, h := range header {
+		available[i] = normalizeHeader(h, i)
+	}
+	return 0, fmt.Errorf("column %q not found in CSV header; available columns: %s", column, strings.Join(available, ", "))
+}
+
+// IndexColumn returns the column selecting the 1-based index, never a header name
+func IndexColumn(index int) string {
+	return "#" + strconv.Itoa(index)
+}
+
+// columnIndex checks that the 1-based index is within header
+func columnIndex(header []string, index int) (int, error) {
+	if index < 1 {
+		return 0, fmt.Errorf("column index must be at least 1, got %d", index)
+	}
+	if len(header) < index {
+		return 0, fmt.Errorf("expected at least %d columns in header, got %d", index, len(header))
+	}
+	return index, nil
+}
+
+// normalizeHeader trims a header cell, dropping the UTF-8 byte order mark some
+// spreadsheet exports put in front of the first column
+func normalizeHeader(h string, index int) string {
+	if index == 0 {
+		h = strings.TrimPrefix(h, "\ufeff")
+	}
+	return strings.TrimSpace(h)
+}
+
+// ProcessCSV processes a CSV file and returns processing results.
+// Rows are numbered in file order and handed to downloadFunc by a pool of
+// workers, so downloadFunc must be safe for concurrent use when more than one
+// worker is configured.
 func (p *Processor) ProcessCSV(csvFile string, urlColumnIndex int, downloadFunc func(url string, rowNum int) error) (*ProcessResult, error) {
+	return p.processFile(context.Background(), csvFile, func(header []string) (int, error) {
+		if len(header) < urlColumnIndex {
+			return 0, fmt.Errorf("expected at least %d columns in header, got %d", urlColumnIndex, len(header))
+		}
+		return urlColumnIndex, nil
+	}, func(ctx context.Context, row Row) error {
+		return downloadFunc(row.URL, row.Num)
+	})
+}
+
+// ProcessCSVColumn processes a CSV file like ProcessCSV, taking URLs from the
+// column selected by header name or 1-based index (see ResolveColumn)
+func (p *Processor) ProcessCSVColumn(csvFile string, column string, downloadFunc func(url string, rowNum int) error) (*ProcessResult, error) {
+	return p.ProcessRows(context.Background(), csvFile, column, func(ctx context.Context, row Row) error {
+		return downloadFunc(row.URL, row.Num)
+	})
+}
+
+// ProcessRows processes a CSV file like ProcessCSVColumn, handing the callback
+// the whole row so it can use other columns as well as the URL. When ctx is
+// canceled no further rows are dispatched; rows already handed to rowFunc
+// receive the same ctx so in-flight work can stop, and the partial result is
+// returned with Canceled set.
+func (p *Processor) ProcessRows(ctx context.Context, csvFile string, column string, rowFunc func(ctx context.Context, row Row) error) (*ProcessResult, error) {
+	return p.processFile(ctx, csvFile, func(header []string) (int, error) {
+		return ResolveColumn(header, column)
+	}, rowFunc)
+}
+
+// processFile reads csvFile, resolves the URL column from its header and
+// dispatches every data row to rowFunc
+func (p *Processor) processFile(ctx context.Context, csvFile string, resolve func(header []string) (int, error), rowFunc func(ctx context.Context, row Row) error) (*ProcessResult, error) {
 	file, err := os.Open(csvFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open CSV file: %v", err)
@@ -31,6 +201,8 @@ func (p *Processor) ProcessCSV(csvFile string, urlColumnIndex int, downloadFunc
 	defer file.Close()
 
 	reader := csv.NewReader(file)
+	// Short rows are reported per row rather than aborting the whole file
+	reader.FieldsPerRecord = -1
 
 	// Read header
 	header, err := reader.Read()
@@ -38,46 +210,156 @@ func (p *Processor) ProcessCSV(csvFile string, urlColumnIndex int, downloadFunc
 		return nil, fmt.Errorf("failed to read CSV header: %v", err)
 	}
 
-	if len(header) < urlColumnIndex {
-		return nil, fmt.Errorf("expected at least %d columns in header, got %d", urlColumnIndex, len(header))
+	urlColumnIndex, err := resolve(header)
+	if err != nil {
+		return nil, err
 	}
 
 	result := &ProcessResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan Row)
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				err := rowFunc(ctx, row)
+
+				mu.Lock()
+				if err != nil {
+					result.ErrorCount++
+					result.Failures = append(result.Failures, NewRowError(row.Num, row.URL, err))
+					if ctx.Err() != nil {
+						result.Canceled = true
+					}
+				} else {
+					result.SuccessCount++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
 	rowNum := 1
 
+dispatch:
 	for {
+		if ctx.Err() != nil {
+			mu.Lock()
+			result.Canceled = true
+			mu.Unlock()
+			break
+		}
+
 		row, err := reader.Read()
 		if err != nil {
 			break
 		}
 
-		result.TotalRows++
+		if p.rows != nil && !p.rows[rowNum] {
+			rowNum++
+			continue
+		}
 
 		if len(row) < urlColumnIndex {
+			mu.Lock()
+			result.TotalRows++
 			result.ErrorCount++
+			result.Failures = append(result.Failures, RowError{
+				Row:      rowNum,
+				Category: CategoryShortRow,
+				Message:  fmt.Sprintf("expected at least %d columns, got %d", urlColumnIndex, len(row)),
+			})
+			mu.Unlock()
 			rowNum++
 			continue
 		}
 
 		imageURL := strings.TrimSpace(row[urlColumnIndex-1])
 		if imageURL == "" {
+			mu.Lock()
+			result.TotalRows++
 			result.ErrorCount++
+			result.Failures = append(result.Failures, RowError{
+				Row:      rowNum,
+				Category: CategoryEmptyCell,
+				Message:  fmt.Sprintf("empty URL in column %d", urlColumnIndex),
+			})
+			mu.Unlock()
 			rowNum++
 			continue
 		}
 
-		if err := downloadFunc(imageURL, rowNum); err != nil {
-			result.ErrorCount++
-		} else {
-			result.SuccessCount++
+		select {
+		case jobs <- Row{Num: rowNum, URL: imageURL, Header: header, Record: row}:
+		case <-ctx.Done():
+			mu.Lock()
+			result.Canceled = true
+			mu.Unlock()
+			break dispatch
 		}
 
+		mu.Lock()
+		result.TotalRows++
+		mu.Unlock()
+
 		rowNum++
 	}
 
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(result.Failures, func(i, j int) bool {
+		return result.Failures[i].Row < result.Failures[j].Row
+	})
+
 	return result, nil
 }
 
+// WriteFailures writes failed rows to a CSV file with a row,url,category,message header
+func WriteFailures(filename string, failures []RowError) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create failures file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write([]string{"row", "url", "category", "message"}); err != nil {
+		return fmt.Errorf("failed to write failures file: %v", err)
+	}
+	for _, f := range failures {
+		if err := writer.Write([]string{strconv.Itoa(f.Row), f.URL, f.Category, f.Message}); err != nil {
+			return fmt.Errorf("failed to write failures file: %v", err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write failures file: %v", err)
+	}
+
+	return file.Close()
+}
+
+// ReadHeader returns the header row of a CSV file
+func ReadHeader(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+
+	header, err := csv.NewReader(file).Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+
+	return header, nil
+}
+
 // ValidateCSVStructure validates the structure of a CSV file
 func (p *Processor) ValidateCSVStructure(filename string, expectedColumns int) error {
 	file, err := os.Open(filename)
@@ -105,6 +387,7 @@ func (p *Processor) ValidateCSVStructure(filename string, expectedColumns int) e
 		if err != nil {
 			break
 		}
+
 		rowCount++
 
 		if len(row) < expectedColumns {
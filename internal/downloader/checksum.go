@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// ChecksumAlgorithm names a digest a download can be verified against
+type ChecksumAlgorithm string
+
+const (
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+)
+
+// ParseChecksumAlgorithm parses md5, sha1 or sha256
+func ParseChecksumAlgorithm(s string) (ChecksumAlgorithm, error) {
+	switch algo := ChecksumAlgorithm(strings.ToLower(s)); algo {
+	case ChecksumMD5, ChecksumSHA1, ChecksumSHA256:
+		return algo, nil
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %q; expected md5, sha1 or sha256", s)
+}
+
+func (a ChecksumAlgorithm) new() hash.Hash {
+	switch a {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumSHA1:
+		return sha1.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// Checksum is the expected digest of an image
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Hex       string // expected digest in hexadecimal, in either case
+}
+
+// verifier hashes a body as it is written and compares it with the expected digest
+type verifier struct {
+	algo ChecksumAlgorithm
+	hash hash.Hash
+	want []byte
+}
+
+// verifier returns a verifier for c, failing when the expected digest is not
+// a hexadecimal digest of the algorithm's length
+func (c *Checksum) verifier() (*verifier, error) {
+	if _, err := ParseChecksumAlgorithm(string(c.Algorithm)); err != nil {
+		return nil, err
+	}
+	h := c.Algorithm.new()
+	want, err := hex.DecodeString(strings.TrimSpace(c.Hex))
+	if err != nil || len(want) != h.Size() {
+		return nil, fmt.Errorf("invalid %s checksum %q: expected %d hexadecimal digits", c.Algorithm, c.Hex, 2*h.Size())
+	}
+	return &verifier{algo: c.Algorithm, hash: h, want: want}, nil
+}
+
+// check returns an error unless the data hashed so far matches the expected digest
+func (v *verifier) check() error {
+	if got := v.hash.Sum(nil); !bytes.Equal(got, v.want) {
+		return fmt.Errorf("%s checksum mismatch: expected %x, got %x", v.algo, v.want, got)
+	}
+	return nil
+}
+
+// verifyFile checks the file at path against c
+func verifyFile(path string, c *Checksum) error {
+	v, err := c.verifier()
+	if err != nil {
+		return &DownloadError{Category: CategoryBadChecksum, Err: err}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return &DownloadError{Category: CategoryIO, Err: fmt.Errorf("failed to open %s: %v", path, err)}
+	}
+	defer f.Close()
+	if _, err := io.Copy(v.hash, f); err != nil {
+		return &DownloadError{Category: CategoryIO, Err: fmt.Errorf("failed to read %s: %v", path, err)}
+	}
+	if err := v.check(); err != nil {
+		return &DownloadError{Category: CategoryChecksum, Err: err}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package downloader
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,54 +15,487 @@ import (
 
 // Downloader handles image downloading operations
 type Downloader struct {
-	client *http.Client
+	client         *http.Client
+	retry          RetryPolicy
+	rejectNonImage bool
+	skipExisting   bool
+	limiter        *limiter // nil when requests are not rate limited
+	userAgent      string
+	header         http.Header
+	auth           func(*http.Request) // nil when no credentials are sent
+	authHosts      []string            // hosts credentials are sent to, empty for all
+	hostHeaders    []HeaderRule
+	fileRoot       string         // directory file:// URLs may read from, "" to reject them
+	maxDataURISize int64          // 0 for DefaultMaxDataURISize
+	maxSize        int64          // largest accepted image, 0 for no limit
+	minSize        int64          // smallest accepted image, 0 for no limit
+	policy         *NetworkPolicy // nil unless safe mode is on
+	redirect       RedirectPolicy
+	store          LinkMode // content store link mode, empty when files are saved directly
+}
+
+// Option configures a Downloader
+type Option func(*Downloader)
+
+// WithRetryPolicy sets how transient download failures are retried
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *Downloader) {
+		d.retry = policy
+	}
+}
+
+// WithRejectNonImage makes downloads fail when the response body is not a
+// recognised image format, such as an HTML error page served with status 200
+func WithRejectNonImage(reject bool) Option {
+	return func(d *Downloader) {
+		d.rejectNonImage = reject
+	}
+}
+
+// WithSkipExisting makes Download return without a request when the target
+// file already exists under any of the image extensions it could be saved with
+func WithSkipExisting(skip bool) Option {
+	return func(d *Downloader) {
+		d.skipExisting = skip
+	}
+}
+
+// WithMaxSize fails downloads larger than n bytes with CategoryTooLarge. A
+// Content-Length above n is rejected before the body is read; otherwise the
+// transfer is aborted as soon as it grows past n.
+func WithMaxSize(n int64) Option {
+	return func(d *Downloader) {
+		d.maxSize = n
+	}
+}
+
+// WithMinSize fails downloads smaller than n bytes with CategoryTooSmall, to
+// catch tiny placeholder images served in place of the real ones
+func WithMinSize(n int64) Option {
+	return func(d *Downloader) {
+		d.minSize = n
+	}
 }
 
 // NewDownloader creates a new downloader instance
-func NewDownloader(timeout time.Duration) *Downloader {
-	return &Downloader{
+func NewDownloader(timeout time.Duration, opts ...Option) *Downloader {
+	d := &Downloader{
 		client: &http.Client{
 			Timeout: timeout,
 		},
+		redirect: DefaultRedirectPolicy(),
 	}
+	d.client.CheckRedirect = d.checkRedirect
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.policy != nil {
+		d.guardTransport()
+	}
+	return d
+}
+
+// Request describes a single image to download
+type Request struct {
+	URL    string // image URL
+	Dir    string // directory the image is saved in
+	RowNum int    // CSV row number, used to name the file
+
+	// Filename returns the file name, relative to Dir, for the detected
+	// extension. When nil the file is named image_<RowNum><ext>.
+	Filename func(ext string) (string, error)
+
+	// Cached, when set, makes the request conditional on a previously
+	// downloaded copy of the image. A 304 response keeps that copy.
+	Cached *Cached
+
+	// Checksum, when set, is verified against the body as it is downloaded.
+	// On a mismatch the download fails with CategoryChecksum and nothing is
+	// saved.
+	Checksum *Checksum
+}
+
+// Cached identifies a previously downloaded image and its HTTP validators
+type Cached struct {
+	Path         string // path of the downloaded file
+	ETag         string // ETag header of the response it was saved from
+	LastModified string // Last-Modified header of the response it was saved from
+}
+
+// Result describes a completed download
+type Result struct {
+	Path         string        // path of the saved file
+	StatusCode   int           // HTTP status of the successful response
+	ContentType  string        // Content-Type header of the successful response
+	ETag         string        // ETag header of the successful response
+	LastModified string        // Last-Modified header of the successful response
+	Bytes        int64         // number of bytes written
+	Attempts     int           // number of attempts made
+	Duration     time.Duration // total time spent, including retries
+	Skipped      bool          // the file already existed and no request was made
+	NotModified  bool          // the server answered 304 and the cached file was kept
+	Redirects    []string      // redirect targets followed, in order
+	FinalURL     string        // URL the image was fetched from, after any redirects
+	SHA256       string        // hex SHA-256 of the downloaded body, empty when none was downloaded
+	Object       string        // path of the content store object, when the content store is used
 }
 
-// DownloadImage downloads an image from a URL and saves it to the specified directory
+// DownloadImage downloads an image from a URL and saves it to the specified directory.
+// Network errors, 5xx and 429 responses are retried according to the retry policy.
 func (d *Downloader) DownloadImage(url, downloadDir string, rowNum int) error {
-	resp, err := d.client.Get(url)
+	_, err := d.Download(context.Background(), Request{URL: url, Dir: downloadDir, RowNum: rowNum})
+	return err
+}
+
+// Download downloads the requested image, retrying transient failures, and
+// reports where it was saved. When an attempt is interrupted part way through
+// and the server supports byte ranges, the next attempt resumes from the data
+// already received. Canceling ctx aborts the request in flight and any pending
+// retry; the partially written file is removed.
+func (d *Downloader) Download(ctx context.Context, req Request) (*Result, error) {
+	if req.Checksum != nil {
+		if _, err := req.Checksum.verifier(); err != nil {
+			return nil, &DownloadError{Category: CategoryBadChecksum, Err: err}
+		}
+	}
+
+	if res, ok := d.Existing(req); ok {
+		return res, nil
+	}
+
+	// part holds the data of an interrupted attempt for the next one to resume
+	var part *partialFile
+	defer func() {
+		if part != nil {
+			part.discard()
+		}
+	}()
+
+	trace := &redirectTrace{}
+	ctx = withRedirectTrace(ctx, trace)
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		trace.urls = nil
+		res, err := d.downloadOnce(ctx, req, &part)
+		if err == nil {
+			res.Attempts = attempt
+			res.Duration = time.Since(start)
+			res.Redirects = trace.urls
+			res.FinalURL = req.URL
+			if len(trace.urls) > 0 {
+				res.FinalURL = trace.urls[len(trace.urls)-1]
+			}
+			return res, nil
+		}
+
+		delay, retry := d.retry.retryDelay(err, attempt)
+		if retry && ctx.Err() == nil {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+
+		dErr := &DownloadError{Category: CategoryIO, Attempts: attempt, Redirects: trace.urls, Err: err}
+		if ae, ok := err.(*attemptError); ok {
+			dErr.Category = ae.category
+			dErr.StatusCode = ae.statusCode
+			dErr.Err = ae.err
+		}
+		if ctx.Err() != nil {
+			dErr.Category = CategoryCanceled
+		}
+		return nil, dErr
+	}
+}
+
+// downloadOnce performs a single download attempt. When *part holds the data
+// of an interrupted attempt the missing bytes are requested with a Range
+// header; an attempt that is interrupted in turn leaves its data in *part.
+func (d *Downloader) downloadOnce(ctx context.Context, req Request, part **partialFile) (*Result, error) {
+	if fetch, ok := d.fetchers()[urlScheme(req.URL)]; ok {
+		return d.fetchOnce(ctx, req, fetch, part)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return nil, &attemptError{err: fmt.Errorf("invalid request: %v", err), category: CategoryInvalidURL}
+	}
+	d.setHeaders(httpReq)
+
+	var cached *Cached
+	if *part != nil {
+		setRangeHeaders(httpReq, *part)
+	} else if req.Cached != nil {
+		// Without the file a 304 would leave nothing on disk
+		if _, err := os.Stat(req.Cached.Path); err == nil {
+			cached = req.Cached
+		}
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			httpReq.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			httpReq.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	release, err := d.limiter.wait(ctx, httpReq.URL.Hostname())
+	if err != nil {
+		return nil, &attemptError{err: fmt.Errorf("waiting for rate limit: %v", err), category: CategoryCanceled}
+	}
+	defer release()
+
+	resp, err := d.client.Do(httpReq)
 	if err != nil {
-		return fmt.Errorf("HTTP request failed: %v", err)
+		return nil, connectError("HTTP request failed", err)
 	}
 	defer resp.Body.Close()
+	respBody := d.limiter.throttle(ctx, httpReq.URL.Hostname(), resp.Body)
+
+	restarted := false
+	if *part != nil {
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			return d.resumeDownload(resp, respBody, part)
+		case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+			// The server ignored the range or the image changed since, so the
+			// data received so far is dropped and the download starts over
+			(*part).discard()
+			*part = nil
+			restarted = true
+		}
+		// Other statuses fail this attempt below; the data is kept for the
+		// next one to resume, or discarded by Download if there is none
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		res := &Result{
+			Path:         cached.Path,
+			StatusCode:   resp.StatusCode,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			NotModified:  true,
+		}
+		if res.ETag == "" {
+			res.ETag = cached.ETag
+		}
+		if res.LastModified == "" {
+			res.LastModified = cached.LastModified
+		}
+		return res, nil
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+		return nil, &attemptError{
+			err:        fmt.Errorf("HTTP status %d", resp.StatusCode),
+			category:   CategoryHTTPStatus,
+			statusCode: resp.StatusCode,
+			// A 416 to a resume request is answered by starting over
+			retryable:  isRetryableStatus(resp.StatusCode) || restarted,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	extension := getExtensionFromContentType(contentType)
-	if extension == "" {
-		extension = GetExtensionFromURL(url)
-		if extension == "" {
-			extension = ".jpg"
+	return d.save(req, respBody, source{
+		statusCode:   resp.StatusCode,
+		contentType:  resp.Header.Get("Content-Type"),
+		size:         resp.ContentLength,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		ranges:       acceptsRanges(resp.Header),
+	}, part)
+}
+
+// source describes the origin of an image body, whatever the URL scheme
+type source struct {
+	statusCode   int    // HTTP status, 0 for other schemes
+	contentType  string // declared media type, "" when unknown
+	size         int64  // expected body length, -1 when unknown
+	etag         string
+	lastModified string
+	ranges       bool // an interrupted transfer can be resumed with a Range request
+}
+
+// save names the image after its detected type and streams body to disk
+func (d *Downloader) save(req Request, r io.Reader, src source, part **partialFile) (*Result, error) {
+	if d.maxSize > 0 && src.size > d.maxSize {
+		return nil, tooLargeError(src.size, d.maxSize)
+	}
+	if d.minSize > 0 && src.size >= 0 && src.size < d.minSize {
+		return nil, tooSmallError(src.size, d.minSize)
+	}
+
+	body := bufio.NewReaderSize(bodyReader{r}, sniffLen)
+	head, err := body.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, readAttemptError(err)
+	}
+
+	// The leading bytes are trusted over the Content-Type header, which some
+	// servers send as application/octet-stream or get wrong
+	extension := DetectImageType(head)
+	if extension == "" && d.rejectNonImage {
+		return nil, &attemptError{
+			err:      fmt.Errorf("response is not an image (Content-Type %q, detected %s)", src.contentType, http.DetectContentType(head)),
+			category: CategoryNotImage,
 		}
 	}
+	if extension == "" {
+		extension = getExtensionFromContentType(src.contentType)
+	}
+	if extension == "" {
+		extension = GetExtensionFromURL(req.URL)
+	}
+	if extension == "" {
+		extension = ".jpg"
+	}
 
-	filename := fmt.Sprintf("image_%d%s", rowNum, extension)
-	filepath := filepath.Join(downloadDir, filename)
+	outPath, err := req.path(extension)
+	if err != nil {
+		return nil, &attemptError{err: err, category: CategoryFilename}
+	}
 
-	file, err := os.Create(filepath)
+	p, err := createPartial(outPath)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return nil, err
+	}
+	p.total = src.size
+	p.contentType = src.contentType
+	p.etag = src.etag
+	p.lastModified = src.lastModified
+	p.ranges = src.ranges
+	p.maxSize = d.maxSize
+	p.dir = req.Dir
+	if req.Checksum != nil {
+		// Checked by Download before the first attempt
+		p.verify, _ = req.Checksum.verifier()
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	return d.finishDownload(p, body, src.statusCode, part)
+}
+
+// resumeDownload appends the body of a 206 response to the interrupted download in *part
+func (d *Downloader) resumeDownload(resp *http.Response, body io.Reader, part **partialFile) (*Result, error) {
+	p := *part
+	*part = nil
+
+	first, complete, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err == nil && first != p.written {
+		err = fmt.Errorf("server resumed at byte %d instead of %d", first, p.written)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+		p.discard()
+		return nil, &attemptError{err: err, category: CategoryIncomplete, retryable: true}
+	}
+
+	switch {
+	case complete >= 0:
+		p.total = complete
+	case resp.ContentLength >= 0:
+		p.total = p.written + resp.ContentLength
+	default:
+		p.total = -1
+	}
+
+	return d.finishDownload(p, bodyReader{body}, resp.StatusCode, part)
+}
+
+// finishDownload streams body into p and moves the file into place. When the
+// body is cut short and the download can be resumed, p is left in *part for
+// the next attempt; otherwise it is removed.
+func (d *Downloader) finishDownload(p *partialFile, body io.Reader, statusCode int, part **partialFile) (*Result, error) {
+	if err := p.copyFrom(body); err != nil {
+		var ae *attemptError
+		if errors.As(err, &ae) && ae.retryable && resumable(p) {
+			*part = p
+		} else {
+			p.discard()
+		}
+		return nil, err
+	}
+
+	if d.minSize > 0 && p.written < d.minSize {
+		p.discard()
+		return nil, tooSmallError(p.written, d.minSize)
+	}
+
+	if p.verify != nil {
+		if err := p.verify.check(); err != nil {
+			p.discard()
+			return nil, &attemptError{err: err, category: CategoryChecksum}
+		}
+	}
+
+	res := &Result{
+		Path:         p.outPath,
+		StatusCode:   statusCode,
+		ContentType:  p.contentType,
+		ETag:         p.etag,
+		LastModified: p.lastModified,
+		Bytes:        p.written,
+		SHA256:       p.sum(),
+	}
+
+	if d.store != "" {
+		object, err := d.storeObject(p, res.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		res.Object = object
+		return res, nil
+	}
+
+	if err := p.commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// path returns where the image is saved for the given extension
+func (req Request) path(ext string) (string, error) {
+	filename := fmt.Sprintf("image_%d%s", req.RowNum, ext)
+	if req.Filename != nil {
+		var err error
+		filename, err = req.Filename(ext)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(req.Dir, filename), nil
+}
+
+// Existing returns the skipped result Download reports for req when the
+// downloader skips existing files and one is already saved for req
+func (d *Downloader) Existing(req Request) (*Result, bool) {
+	if !d.skipExisting {
+		return nil, false
 	}
+	path, ok := existingFile(req)
+	if !ok {
+		return nil, false
+	}
+	return &Result{Path: path, Skipped: true}, true
+}
 
-	return nil
+// existingFile returns the path of a regular file already saved for req under
+// any extension a download could be given
+func existingFile(req Request) (string, bool) {
+	for _, ext := range imageExtensions {
+		path, err := req.path(ext)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, true
+		}
+	}
+	return "", false
 }
 
 // getExtensionFromContentType determines file extension from HTTP content-type header
@@ -79,6 +515,14 @@ func getExtensionFromContentType(contentType string) string {
 		return ".bmp"
 	case strings.Contains(contentType, "image/tiff"):
 		return ".tiff"
+	case strings.Contains(contentType, "image/avif"):
+		return ".avif"
+	case strings.Contains(contentType, "image/heic"), strings.Contains(contentType, "image/heif"):
+		return ".heic"
+	case strings.Contains(contentType, "image/svg+xml"):
+		return ".svg"
+	case strings.Contains(contentType, "image/x-icon"), strings.Contains(contentType, "image/vnd.microsoft.icon"):
+		return ".ico"
 	default:
 		return ""
 	}
@@ -101,18 +545,28 @@ func GetExtensionFromContentType(contentType string) string {
 		return ".bmp"
 	case strings.Contains(contentType, "image/tiff"):
 		return ".tiff"
+	case strings.Contains(contentType, "image/avif"):
+		return ".avif"
+	case strings.Contains(contentType, "image/heic"), strings.Contains(contentType, "image/heif"):
+		return ".heic"
+	case strings.Contains(contentType, "image/svg+xml"):
+		return ".svg"
+	case strings.Contains(contentType, "image/x-icon"), strings.Contains(contentType, "image/vnd.microsoft.icon"):
+		return ".ico"
 	default:
 		return ""
 	}
 }
 
+// imageExtensions lists every extension a downloaded image can be saved with
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".tiff", ".tif", ".avif", ".heic", ".heif", ".svg", ".ico"}
+
 // GetExtensionFromURL determines file extension from URL path
 func GetExtensionFromURL(url string) string {
 	ext := filepath.Ext(url)
 	if ext != "" {
 		ext = strings.ToLower(ext)
-		validExts := []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".tiff", ".tif"}
-		for _, validExt := range validExts {
+		for _, validExt := range imageExtensions {
 			if ext == validExt {
 				return ext
 			}
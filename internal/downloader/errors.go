@@ -0,0 +1,145 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/sbleks/go-get-imgs/internal/utils"
+)
+
+// Failure categories reported for rows that could not be downloaded
+const (
+	CategoryInvalidURL  = "invalid-url"
+	CategoryHTTPStatus  = "http-status"
+	CategoryTimeout     = "timeout"
+	CategoryNetwork     = "network"
+	CategoryIO          = "io"
+	CategoryFilename    = "filename"
+	CategoryNotImage    = "not-image"
+	CategoryIncomplete  = "incomplete"
+	CategoryCanceled    = "canceled"
+	CategoryFTPStatus   = "ftp-status"
+	CategoryOutsideRoot = "outside-root"
+	CategoryTooLarge    = "too-large"
+	CategoryTooSmall    = "too-small"
+	CategoryBlocked     = "blocked"
+	CategoryRedirect    = "redirect"
+	CategoryPlaceholder = "placeholder"
+	CategoryChecksum    = "checksum-mismatch"
+	CategoryBadChecksum = "bad-checksum"
+)
+
+// DownloadError describes a download that failed after all attempts
+type DownloadError struct {
+	Category   string   // failure category, one of the Category constants
+	StatusCode int      // HTTP status of the last attempt, 0 when no response was received
+	Attempts   int      // number of attempts made, 0 when the URL was rejected before any request
+	Redirects  []string // redirect targets of the last attempt, in order
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	switch e.Attempts {
+	case 0:
+		return e.Err.Error()
+	case 1:
+		return fmt.Sprintf("%v (after 1 attempt)", e.Err)
+	default:
+		return fmt.Sprintf("%v (after %d attempts)", e.Err, e.Attempts)
+	}
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// FailureCategory returns the failure category of the download
+func (e *DownloadError) FailureCategory() string {
+	return e.Category
+}
+
+// InvalidURLError returns the error reported for a URL rejected before download
+func InvalidURLError(url string) error {
+	return &DownloadError{Category: CategoryInvalidURL, Err: fmt.Errorf("invalid URL format: %s", utils.DisplayURL(url))}
+}
+
+// tooLargeError reports a body of size bytes, or more, exceeding the limit
+func tooLargeError(size, limit int64) *attemptError {
+	return &attemptError{err: fmt.Errorf("body of %d bytes or more exceeds the %d byte limit", size, limit), category: CategoryTooLarge}
+}
+
+// tooSmallError reports a body of size bytes below the minimum
+func tooSmallError(size, limit int64) *attemptError {
+	return &attemptError{err: fmt.Errorf("body of %d bytes is smaller than the %d byte minimum", size, limit), category: CategoryTooSmall}
+}
+
+// connectError classifies a failure to reach a server. Connections refused
+// by the network policy and redirects refused by the redirect policy are
+// final; other failures are retried.
+func connectError(what string, err error) *attemptError {
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		return &attemptError{err: fmt.Errorf("%s: %v", what, blocked), category: CategoryBlocked}
+	}
+	var refused *redirectError
+	if errors.As(err, &refused) {
+		return &attemptError{err: fmt.Errorf("%s: %v", what, refused), category: refused.category}
+	}
+	return &attemptError{err: fmt.Errorf("%s: %v", what, err), category: networkCategory(err), retryable: true}
+}
+
+// readError marks a failure reading the response body, as opposed to writing the file
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+// bodyReader wraps a response body so read failures can be told apart from write failures
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &readError{err: err}
+	}
+	return n, err
+}
+
+// readAttemptError wraps a failure reading the response body as a retryable
+// attempt error. Attempt errors from the body itself, such as the FTP reply
+// closing a transfer, are returned unchanged.
+func readAttemptError(err error) *attemptError {
+	var rErr *readError
+	if errors.As(err, &rErr) {
+		err = rErr.err
+	}
+	if aErr, ok := err.(*attemptError); ok {
+		return aErr
+	}
+	return &attemptError{err: fmt.Errorf("failed to read response body: %v", err), category: networkCategory(err), retryable: true}
+}
+
+// networkCategory classifies a transport or body read error
+func networkCategory(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return CategoryCanceled
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return CategoryTimeout
+	}
+	return CategoryNetwork
+}
@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fetched is an image body opened by a fetcher
+type fetched struct {
+	body        io.ReadCloser
+	size        int64  // body length, -1 when unknown
+	contentType string // media type guessed from the name, "" when unknown
+}
+
+// fetcher opens the image at rawURL for a single attempt. Failures are
+// returned as *attemptError so they are categorised and retried like HTTP ones.
+type fetcher func(ctx context.Context, rawURL string) (*fetched, error)
+
+// fetchers returns the fetchers for the URL schemes served without HTTP
+func (d *Downloader) fetchers() map[string]fetcher {
+	return map[string]fetcher{
+		"file": d.fetchFile,
+		"ftp":  d.fetchFTP,
+		"data": d.fetchData,
+	}
+}
+
+// urlScheme returns the lower-cased scheme of rawURL, or "" when it has none
+func urlScheme(rawURL string) string {
+	scheme, _, ok := strings.Cut(strings.TrimSpace(rawURL), ":")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(scheme)
+}
+
+// parseURL parses rawURL for a fetcher, reporting failures as invalid URLs
+func parseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &attemptError{err: fmt.Errorf("invalid URL: %v", err), category: CategoryInvalidURL}
+	}
+	return u, nil
+}
+
+// WithFileRoot allows file:// URLs that point inside root. Without it every
+// file:// URL is rejected, since a CSV could otherwise read any local file.
+func WithFileRoot(root string) Option {
+	return func(d *Downloader) {
+		d.fileRoot = root
+	}
+}
+
+// fetchOnce performs a single attempt for a URL handled by fetch
+func (d *Downloader) fetchOnce(ctx context.Context, req Request, fetch fetcher, part **partialFile) (*Result, error) {
+	var host string
+	if u, err := url.Parse(req.URL); err == nil {
+		host = u.Hostname()
+	}
+	if host != "" {
+		release, err := d.limiter.wait(ctx, host)
+		if err != nil {
+			return nil, &attemptError{err: fmt.Errorf("waiting for rate limit: %v", err), category: CategoryCanceled}
+		}
+		defer release()
+	}
+
+	f, err := fetch(ctx, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer f.body.Close()
+
+	var body io.Reader = f.body
+	if host != "" {
+		body = d.limiter.throttle(ctx, host, body)
+	}
+
+	return d.save(req, body, source{contentType: f.contentType, size: f.size}, part)
+}
+
+// fetchFile opens a file:// URL inside the configured file root
+func (d *Downloader) fetchFile(ctx context.Context, rawURL string) (*fetched, error) {
+	if d.fileRoot == "" {
+		return nil, &attemptError{err: fmt.Errorf("file URLs are not allowed without a file root"), category: CategoryOutsideRoot}
+	}
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		return nil, &attemptError{err: fmt.Errorf("file URL with remote host %q", u.Host), category: CategoryInvalidURL}
+	}
+
+	name := u.Path
+	if len(name) >= 3 && name[0] == '/' && name[2] == ':' {
+		// file:///C:/images/a.png names a Windows drive path
+		name = name[1:]
+	}
+
+	path, err := insideRoot(d.fileRoot, filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &attemptError{err: fmt.Errorf("failed to open file: %v", err), category: CategoryIO}
+	}
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &attemptError{err: fmt.Errorf("%s is not a regular file", path), category: CategoryIO}
+	}
+
+	return &fetched{body: file, size: info.Size(), contentType: mime.TypeByExtension(filepath.Ext(path))}, nil
+}
+
+// insideRoot resolves symlinks in path and root and returns path when it
+// lies within root
+func insideRoot(root, path string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", &attemptError{err: fmt.Errorf("invalid file root: %v", err), category: CategoryIO}
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return "", &attemptError{err: fmt.Errorf("invalid file root: %v", err), category: CategoryIO}
+	}
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", &attemptError{err: fmt.Errorf("file not found: %s", path), category: CategoryIO}
+	}
+	if err != nil {
+		return "", &attemptError{err: fmt.Errorf("failed to resolve file: %v", err), category: CategoryIO}
+	}
+	realPath, err = filepath.Abs(realPath)
+	if err != nil {
+		return "", &attemptError{err: fmt.Errorf("failed to resolve file: %v", err), category: CategoryIO}
+	}
+
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", &attemptError{err: fmt.Errorf("%s is outside the file root %s", path, root), category: CategoryOutsideRoot}
+	}
+
+	return realPath, nil
+}
@@ -0,0 +1,218 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fetchFTP retrieves an ftp:// URL in passive mode. Credentials are taken
+// from the URL and default to anonymous login. As in RFC 1738 the path is
+// relative to the login directory; a leading %2F makes it absolute.
+func (d *Downloader) fetchFTP(ctx context.Context, rawURL string) (*fetched, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if name == "" {
+		return nil, &attemptError{err: fmt.Errorf("FTP URL has no file path"), category: CategoryInvalidURL}
+	}
+
+	conn, err := d.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, connectError("FTP connection failed", err)
+	}
+
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if d.client.Timeout > 0 {
+		c.deadline = time.Now().Add(d.client.Timeout)
+		conn.SetDeadline(c.deadline)
+	}
+	c.stop = context.AfterFunc(ctx, c.close)
+
+	body, err := c.retrieve(ctx, u, name)
+	if err != nil {
+		c.stop()
+		c.close()
+		if ctx.Err() != nil {
+			return nil, &attemptError{err: ctx.Err(), category: CategoryCanceled}
+		}
+		return nil, err
+	}
+
+	return &fetched{body: body, size: c.size, contentType: mime.TypeByExtension(path.Ext(name))}, nil
+}
+
+// ftpConn is the control connection of a single FTP retrieval
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	data net.Conn
+	stop func() bool // unregisters the context cancellation hook
+	size int64
+
+	deadline time.Time // zero when the transfer has no time limit
+}
+
+// close tears down the data and control connections
+func (c *ftpConn) close() {
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.text.Close()
+}
+
+// cmd sends a command and reads its reply, failing unless the reply code
+// starts with one of the expected digits
+func (c *ftpConn) cmd(expect string, format string, args ...any) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", &attemptError{err: fmt.Errorf("FTP command failed: %v", err), category: networkCategory(err), retryable: true}
+	}
+	return c.reply(expect, strings.Fields(format)[0])
+}
+
+// reply reads a reply for command, failing unless its code starts with one of
+// the expected digits. 4xx replies are transient in FTP and retried.
+func (c *ftpConn) reply(expect, command string) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil && code == 0 {
+		return 0, "", &attemptError{err: fmt.Errorf("FTP %s failed: %v", command, err), category: networkCategory(err), retryable: true}
+	}
+	if !strings.ContainsRune(expect, rune('0'+code/100)) {
+		return code, msg, &attemptError{
+			err:       fmt.Errorf("FTP %s failed: %d %s", command, code, msg),
+			category:  CategoryFTPStatus,
+			retryable: code >= 400 && code < 500,
+		}
+	}
+	return code, msg, nil
+}
+
+// retrieve logs in, opens a passive data connection and starts the transfer of name
+func (c *ftpConn) retrieve(ctx context.Context, u *url.URL, name string) (io.ReadCloser, error) {
+	if _, _, err := c.reply("2", "greeting"); err != nil {
+		return nil, err
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	code, _, err := c.cmd("23", "USER %s", user)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		if _, _, err := c.cmd("2", "PASS %s", password); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, _, err := c.cmd("2", "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	// SIZE is optional; without it the transfer length is not checked
+	c.size = -1
+	if code, msg, err := c.cmd("2", "SIZE %s", name); err == nil && code == 213 {
+		if size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			c.size = size
+		}
+	}
+
+	port, err := c.passivePort()
+	if err != nil {
+		return nil, err
+	}
+	// The data connection goes to the control host rather than any address
+	// the server names, which could point elsewhere. That address has already
+	// passed the safe mode checks.
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	dialer := net.Dialer{Deadline: c.deadline}
+	c.data, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, connectError("FTP data connection failed", err)
+	}
+	c.data.SetDeadline(c.deadline)
+
+	if _, _, err := c.cmd("1", "RETR %s", name); err != nil {
+		return nil, err
+	}
+
+	return &ftpBody{c: c}, nil
+}
+
+// passivePort asks for a passive data port, trying EPSV before PASV
+func (c *ftpConn) passivePort() (int, error) {
+	if _, msg, err := c.cmd("2", "EPSV"); err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			if port, err := strconv.Atoi(msg[start+4 : end]); err == nil {
+				return port, nil
+			}
+		}
+	}
+
+	_, msg, err := c.cmd("2", "PASV")
+	if err != nil {
+		return 0, err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start >= 0 && end > start {
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) == 6 {
+			p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+			p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+			if err1 == nil && err2 == nil {
+				return p1<<8 | p2, nil
+			}
+		}
+	}
+	return 0, &attemptError{err: fmt.Errorf("FTP PASV failed: malformed reply %q", msg), category: CategoryNetwork, retryable: true}
+}
+
+// ftpBody reads the data connection of a transfer. At the end of the data it
+// checks the server's completion reply, so a transfer the server aborted is
+// reported as an error rather than a short file.
+type ftpBody struct {
+	c    *ftpConn
+	done bool
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	n, err := b.c.data.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		if _, _, rErr := b.c.reply("2", "RETR"); rErr != nil {
+			return n, rErr
+		}
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	b.c.stop()
+	if b.done {
+		b.c.text.PrintfLine("QUIT")
+	}
+	b.c.close()
+	return nil
+}
@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// WithUserAgent sets the User-Agent sent with every request. Without it Go's
+// default User-Agent is sent, which some CDNs block.
+func WithUserAgent(userAgent string) Option {
+	return func(d *Downloader) {
+		d.userAgent = userAgent
+	}
+}
+
+// WithHeaders adds headers to every request
+func WithHeaders(header http.Header) Option {
+	return func(d *Downloader) {
+		d.header = header.Clone()
+	}
+}
+
+// WithBasicAuth sends HTTP Basic credentials with every request, or with the
+// requests to the hosts given to WithAuthHosts
+func WithBasicAuth(username, password string) Option {
+	return func(d *Downloader) {
+		d.auth = func(req *http.Request) {
+			req.SetBasicAuth(username, password)
+		}
+	}
+}
+
+// WithBearerToken sends token as an Authorization: Bearer header with every
+// request, or with the requests to the hosts given to WithAuthHosts
+func WithBearerToken(token string) Option {
+	return func(d *Downloader) {
+		d.auth = func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+}
+
+// WithAuthHosts restricts the credentials of WithBasicAuth and WithBearerToken
+// to hosts matching one of the host names or *.domain patterns. Without it
+// they are sent to every host a CSV names.
+func WithAuthHosts(hosts []string) Option {
+	return func(d *Downloader) {
+		d.authHosts = append([]string(nil), hosts...)
+	}
+}
+
+// WithCookieJar stores cookies received from servers in jar and sends the
+// matching ones with every request
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(d *Downloader) {
+		d.client.Jar = jar
+	}
+}
+
+// HeaderRule adds headers to the requests sent to matching hosts
+type HeaderRule struct {
+	// Host is a host name without port, or a pattern such as *.example.com
+	// matching every subdomain of example.com
+	Host   string
+	Header http.Header
+}
+
+// matches reports whether the rule applies to host
+func (r HeaderRule) matches(host string) bool {
+	return hostMatches(r.Host, host)
+}
+
+// WithHostHeaders adds headers to the requests sent to the hosts the rules
+// match. They are applied after the headers set for every request, wildcard
+// rules before exact ones and shorter domains before longer ones, so the most
+// specific rule wins: *.cdn.example.com overrides *.example.com.
+func WithHostHeaders(rules []HeaderRule) Option {
+	return func(d *Downloader) {
+		d.hostHeaders = append([]HeaderRule(nil), rules...)
+		sort.SliceStable(d.hostHeaders, func(i, j int) bool {
+			return d.hostHeaders[i].specificity() < d.hostHeaders[j].specificity()
+		})
+	}
+}
+
+// specificity orders rules by how narrowly they match: wildcard rules by the
+// length of their domain, then exact host names above all of them
+func (r HeaderRule) specificity() int {
+	if suffix, ok := strings.CutPrefix(r.Host, "*."); ok {
+		return len(suffix)
+	}
+	return math.MaxInt
+}
+
+// LoadHeaderRules reads per-host header rules from a JSON file mapping host
+// names or *.domain patterns to header names and values:
+//
+//	{
+//	  "assets.example.com": {"Authorization": "Bearer abc123"},
+//	  "*.cdn.example.com": {"Referer": "https://www.example.com/"}
+//	}
+func LoadHeaderRules(path string) ([]HeaderRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header rules: %v", err)
+	}
+
+	var hosts map[string]map[string]string
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("failed to parse header rules %s: %v", path, err)
+	}
+
+	rules := make([]HeaderRule, 0, len(hosts))
+	for host, headers := range hosts {
+		if strings.TrimSpace(host) == "" {
+			return nil, fmt.Errorf("header rules %s: empty host name", path)
+		}
+		rule := HeaderRule{Host: host, Header: make(http.Header, len(headers))}
+		for name, value := range headers {
+			rule.Header.Set(name, value)
+		}
+		rules = append(rules, rule)
+	}
+
+	// Map order is random; sorting keeps the precedence between rules stable
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Host < rules[j].Host
+	})
+
+	return rules, nil
+}
+
+// setHeaders adds the configured User-Agent, headers, credentials and host
+// rules to req
+func (d *Downloader) setHeaders(req *http.Request) {
+	if d.userAgent != "" {
+		req.Header.Set("User-Agent", d.userAgent)
+	}
+	for name, values := range d.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	host := req.URL.Hostname()
+	if d.auth != nil && d.sendsAuth(host) {
+		d.auth(req)
+	}
+
+	for _, rule := range d.hostHeaders {
+		if !rule.matches(host) {
+			continue
+		}
+		for name, values := range rule.Header {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// sendsAuth reports whether credentials are sent to host
+func (d *Downloader) sendsAuth(host string) bool {
+	if len(d.authHosts) == 0 {
+		return true
+	}
+	for _, pattern := range d.authHosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
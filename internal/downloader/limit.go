@@ -0,0 +1,228 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits controls how hard the downloader leans on the servers it fetches from
+type Limits struct {
+	RPS       float64               // requests per second across all hosts; 0 means no limit
+	Bandwidth int64                 // response bytes per second across all hosts; 0 means no limit
+	Host      HostLimits            // limits applied to every host without an entry in Hosts
+	Hosts     map[string]HostLimits // per-host overrides keyed by host name, without port
+}
+
+// HostLimits bounds the requests sent to a single host
+type HostLimits struct {
+	RPS       float64 // requests per second; 0 means no limit
+	MaxConns  int     // requests in flight at once, including reading the body; 0 means no limit
+	Bandwidth int64   // response bytes per second; 0 means no limit
+}
+
+// WithLimits sets global and per-host rate limits. Every attempt, including
+// retries, waits for its turn before the request is sent, and response bodies
+// are read no faster than the bandwidth limits allow, shared by all downloads
+// in flight.
+func WithLimits(limits Limits) Option {
+	return func(d *Downloader) {
+		d.limiter = newLimiter(limits)
+	}
+}
+
+// limiter enforces Limits. A nil limiter allows every request immediately.
+type limiter struct {
+	limits    Limits
+	global    *bucket
+	bandwidth *bucket
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+// hostLimiter holds the rate and concurrency state of one host
+type hostLimiter struct {
+	bucket    *bucket       // nil when the host has no rate limit
+	slots     chan struct{} // nil when the host has no connection limit
+	bandwidth *bucket       // nil when the host has no bandwidth limit
+}
+
+func newLimiter(limits Limits) *limiter {
+	hosts := make(map[string]HostLimits, len(limits.Hosts))
+	for host, hl := range limits.Hosts {
+		hosts[strings.ToLower(host)] = hl
+	}
+	limits.Hosts = hosts
+
+	return &limiter{
+		limits:    limits,
+		global:    newBucket(limits.RPS, 1),
+		bandwidth: newByteBucket(limits.Bandwidth),
+		hosts:     make(map[string]*hostLimiter),
+	}
+}
+
+// host returns the limiter state for host, creating it on first use
+func (l *limiter) host(host string) *hostLimiter {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.hosts[host]; ok {
+		return h
+	}
+
+	hl, ok := l.limits.Hosts[host]
+	if !ok {
+		hl = l.limits.Host
+	}
+	h := &hostLimiter{bucket: newBucket(hl.RPS, 1), bandwidth: newByteBucket(hl.Bandwidth)}
+	if hl.MaxConns > 0 {
+		h.slots = make(chan struct{}, hl.MaxConns)
+	}
+	l.hosts[host] = h
+	return h
+}
+
+// wait blocks until a request to host may be sent and returns the function
+// that frees its connection slot once the response has been read
+func (l *limiter) wait(ctx context.Context, host string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	h := l.host(host)
+	release = func() {}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+			release = func() { <-h.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	now := time.Now()
+	delay := max(h.bucket.reserve(now, 1), l.global.reserve(now, 1))
+	if err := sleep(ctx, delay); err != nil {
+		release()
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// throttle wraps a response body from host so it is read no faster than the
+// global and per-host bandwidth limits allow
+func (l *limiter) throttle(ctx context.Context, host string, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	var buckets []*bucket
+	for _, b := range []*bucket{l.bandwidth, l.host(host).bandwidth} {
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	if len(buckets) == 0 {
+		return r
+	}
+
+	return &throttledReader{ctx: ctx, r: r, buckets: buckets}
+}
+
+// throttledReader delays reads until the bytes returned fit within its buckets
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*bucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Reading at most one burst at a time keeps the rate smooth
+	for _, b := range t.buckets {
+		if burst := int(b.burst); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		now := time.Now()
+		var delay time.Duration
+		for _, b := range t.buckets {
+			delay = max(delay, b.reserve(now, float64(n)))
+		}
+		if sErr := sleep(t.ctx, delay); sErr != nil {
+			return n, sErr
+		}
+	}
+	return n, err
+}
+
+// sleep waits for d or until ctx is canceled
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bucket is a token bucket refilled at rate tokens per second and holding at
+// most burst tokens. Tokens are taken up front and may go into debt, which
+// later callers wait off in turn. A nil bucket never delays.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket for rate, or nil when rate is not positive
+func newBucket(rate, burst float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// newByteBucket returns a bucket for a bandwidth limit in bytes per second,
+// allowing bursts of a tenth of a second
+func newByteBucket(rate int64) *bucket {
+	return newBucket(float64(rate), max(float64(rate)/10, 1024))
+}
+
+// reserve takes n tokens and returns how long to wait before they may be used
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LinkMode says how a request is satisfied from a file saved for another one
+type LinkMode string
+
+const (
+	LinkHardlink LinkMode = "hardlink" // a hard link, or a copy where hard links are not possible
+	LinkSymlink  LinkMode = "symlink"  // a relative symbolic link
+	LinkCopy     LinkMode = "copy"     // an independent copy
+)
+
+// ParseLinkMode parses hardlink, symlink or copy
+func ParseLinkMode(s string) (LinkMode, error) {
+	switch mode := LinkMode(s); mode {
+	case LinkHardlink, LinkSymlink, LinkCopy:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown link mode %q; expected hardlink, symlink or copy", s)
+}
+
+// Link saves src, a file already downloaded for another request, under the
+// file name of req with src's extension. No request is made; req.Checksum,
+// if set, is verified against src. The file is put in place atomically,
+// replacing any existing one.
+func Link(req Request, src string, mode LinkMode) (*Result, error) {
+	start := time.Now()
+	if req.Checksum != nil {
+		if err := verifyFile(src, req.Checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	dst, err := req.path(filepath.Ext(src))
+	if err != nil {
+		return nil, &DownloadError{Category: CategoryFilename, Err: err}
+	}
+
+	if !samePath(src, dst) {
+		if err := linkFile(src, dst, mode); err != nil {
+			return nil, &DownloadError{Category: CategoryIO, Err: err}
+		}
+	}
+	return &Result{Path: dst, Duration: time.Since(start)}, nil
+}
+
+// linkFile creates dst as a link to or copy of src
+func linkFile(src, dst string, mode LinkMode) error {
+	switch mode {
+	case LinkSymlink:
+		target, err := relativeTarget(src, dst)
+		if err != nil {
+			return err
+		}
+		return placeLink(dst, func(tmp string) error {
+			return os.Symlink(target, tmp)
+		})
+	case LinkHardlink:
+		// Hard links fail across file systems and on some, such as FAT
+		if err := placeLink(dst, func(tmp string) error { return os.Link(src, tmp) }); err == nil {
+			return nil
+		}
+	}
+	return copyFile(src, dst)
+}
+
+// placeLink creates a link under a temporary name next to dst and renames it
+// into place
+func placeLink(dst string, link func(tmp string) error) error {
+	p, err := createPartial(dst)
+	if err != nil {
+		return err
+	}
+	// The temporary file only reserves a name for the link
+	tmp := p.file.Name()
+	p.discard()
+
+	if err := link(tmp); err != nil {
+		return fmt.Errorf("failed to link file: %v", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move file into place: %v", err)
+	}
+	return nil
+}
+
+// copyFile copies src to dst through a temporary file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	p, err := createPartial(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(p.file, in); err != nil {
+		p.discard()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return p.commit()
+}
+
+// relativeTarget returns the path of src relative to the directory of dst, so
+// symbolic links keep working when the output directory is moved
+func relativeTarget(src, dst string) (string, error) {
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", src, err)
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", dst, err)
+	}
+	return filepath.Rel(filepath.Dir(absDst), absSrc)
+}
+
+// samePath reports whether a and b name the same location
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
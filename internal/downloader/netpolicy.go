@@ -0,0 +1,160 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NetworkPolicy restricts the addresses downloads may connect to, for CSVs
+// from untrusted sources. Loopback, link-local, private, multicast,
+// unspecified and reserved addresses are refused unless allowed here.
+type NetworkPolicy struct {
+	AllowHosts []string       // host names or *.domain patterns exempt from the checks
+	AllowNets  []netip.Prefix // address ranges allowed even though they would be refused
+
+	// TrustProxy keeps the transport's proxy. Only the proxy's address is
+	// checked then, so it is meant for a proxy configured explicitly, which
+	// has to enforce its own policy. Without it requests are never proxied,
+	// whatever HTTP_PROXY and HTTPS_PROXY say.
+	TrustProxy bool
+}
+
+// WithSafeMode refuses connections to internal addresses. The check is made
+// on the resolved address at connect time, so it also covers redirects and
+// host names that resolve differently on a second lookup. It applies to the
+// default transport and to any *http.Transport, such as those built by
+// NewTransport; HTTP requests through other transports are refused.
+func WithSafeMode(policy NetworkPolicy) Option {
+	return func(d *Downloader) {
+		d.policy = &policy
+	}
+}
+
+// reservedNets are ranges refused in safe mode on top of those the net/netip
+// predicates cover
+var reservedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach any IPv4 address
+}
+
+// blockedError reports a connection refused by the network policy
+type blockedError struct {
+	addr      netip.Addr
+	transport string // type of a transport whose connections cannot be checked, when addr is unset
+}
+
+func (e *blockedError) Error() string {
+	if e.transport != "" {
+		return fmt.Sprintf("request blocked by safe mode: connections of transport %s cannot be checked", e.transport)
+	}
+	return fmt.Sprintf("connection to %s blocked by safe mode", e.addr)
+}
+
+// uncheckedTransport refuses every request in place of a transport the
+// network policy cannot be enforced on, so safe mode never fails open
+type uncheckedTransport struct {
+	transport http.RoundTripper
+}
+
+func (t uncheckedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, &blockedError{transport: fmt.Sprintf("%T", t.transport)}
+}
+
+// allowsHost reports whether host is exempt from the address checks
+func (p *NetworkPolicy) allowsHost(host string) bool {
+	for _, pattern := range p.AllowHosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a *blockedError when addr may not be connected to
+func (p *NetworkPolicy) check(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, allowed := range p.AllowNets {
+		if allowed.Contains(addr) {
+			return nil
+		}
+	}
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return &blockedError{addr: addr}
+	}
+	for _, reserved := range reservedNets {
+		if reserved.Contains(addr) {
+			return &blockedError{addr: addr}
+		}
+	}
+	return nil
+}
+
+// control checks the resolved address of every connection attempt
+func (p *NetworkPolicy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("safe mode cannot check address %q: %v", address, err)
+	}
+	return p.check(addrPort.Addr())
+}
+
+// dialContext connects to addr, applying the network policy when one is set
+func (d *Downloader) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if d.policy != nil {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || !d.policy.allowsHost(host) {
+			dialer.Control = d.policy.control
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// guardTransport routes the client's connections through dialContext so the
+// network policy is enforced. Other transports than *http.Transport do not
+// expose their dialer, so every HTTP request through them is refused.
+func (d *Downloader) guardTransport() {
+	var transport *http.Transport
+	switch t := d.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		d.client.Transport = uncheckedTransport{transport: t}
+		return
+	}
+	transport.DialContext = d.dialContext
+	if !d.policy.TrustProxy {
+		// Through a proxy only the proxy's address would be checked
+		transport.Proxy = nil
+	}
+	d.client.Transport = transport
+}
+
+// hostMatches reports whether host matches a host name or a *.domain pattern
+// covering every subdomain of domain
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RedirectPolicy controls which redirects are followed
+type RedirectPolicy struct {
+	MaxRedirects int              // redirects followed per attempt; 0 follows none
+	SameHost     bool             // refuse redirects to a different host name
+	NoDowngrade  bool             // refuse redirects from https to http
+	Placeholders []*regexp.Regexp // redirect targets matching any of these fail with CategoryPlaceholder
+}
+
+// DefaultRedirectPolicy returns the redirect policy of net/http, which
+// follows up to 10 redirects anywhere
+func DefaultRedirectPolicy() RedirectPolicy {
+	return RedirectPolicy{MaxRedirects: 10}
+}
+
+// WithRedirectPolicy sets which redirects are followed
+func WithRedirectPolicy(policy RedirectPolicy) Option {
+	return func(d *Downloader) {
+		d.redirect = policy
+	}
+}
+
+// redirectError reports a redirect refused by the redirect policy
+type redirectError struct {
+	category string
+	err      error
+}
+
+func (e *redirectError) Error() string {
+	return e.err.Error()
+}
+
+// redirectTrace collects the redirect targets of the current attempt
+type redirectTrace struct {
+	urls []string
+}
+
+type redirectTraceKey struct{}
+
+// withRedirectTrace returns a context whose requests record their redirects in trace
+func withRedirectTrace(ctx context.Context, trace *redirectTrace) context.Context {
+	return context.WithValue(ctx, redirectTraceKey{}, trace)
+}
+
+// checkRedirect is the client's CheckRedirect hook. Every target is recorded,
+// including a refused one, so the report shows where a URL was sent.
+func (d *Downloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	target := req.URL.String()
+	if trace, ok := req.Context().Value(redirectTraceKey{}).(*redirectTrace); ok {
+		trace.urls = append(trace.urls, target)
+	}
+
+	p := d.redirect
+	prev := via[len(via)-1]
+	switch {
+	case len(via) > p.MaxRedirects:
+		return &redirectError{category: CategoryRedirect, err: fmt.Errorf("stopped after %d redirects", p.MaxRedirects)}
+	case p.SameHost && !strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname()):
+		return &redirectError{category: CategoryRedirect, err: fmt.Errorf("refused redirect to another host: %s", target)}
+	case p.NoDowngrade && prev.URL.Scheme == "https" && req.URL.Scheme == "http":
+		return &redirectError{category: CategoryRedirect, err: fmt.Errorf("refused redirect from https to http: %s", target)}
+	}
+	for _, pattern := range p.Placeholders {
+		if pattern.MatchString(target) {
+			return &redirectError{category: CategoryPlaceholder, err: fmt.Errorf("redirected to placeholder image %s", target)}
+		}
+	}
+	return nil
+}
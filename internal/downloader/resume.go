@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsRanges reports whether a response advertises byte range support
+func acceptsRanges(header http.Header) bool {
+	for _, unit := range strings.Split(header.Get("Accept-Ranges"), ",") {
+		if strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+			return true
+		}
+	}
+	return false
+}
+
+// isWeakETag reports whether etag is a weak validator, which If-Range does not accept
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// resumable reports whether an interrupted download can be continued with a
+// Range request on the next attempt
+func resumable(p *partialFile) bool {
+	return p.written > 0 && p.ranges && p.validator() != ""
+}
+
+// setRangeHeaders asks the server for the bytes after those already received,
+// falling back to the whole image if it changed since
+func setRangeHeaders(req *http.Request, p *partialFile) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.written))
+	req.Header.Set("If-Range", p.validator())
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/complete" and returns the first byte position and the
+// complete length, -1 when the server sent "*"
+func parseContentRange(value string) (first, complete int64, err error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported Content-Range %q", value)
+	}
+
+	span, size, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	start, _, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", value)
+	}
+
+	first, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", value)
+	}
+
+	complete = -1
+	if size != "*" {
+		complete, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || complete < 0 {
+			return 0, 0, fmt.Errorf("malformed Content-Range %q", value)
+		}
+	}
+
+	return first, complete, nil
+}
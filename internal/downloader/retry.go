@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed downloads are retried
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts including the first; values below 1 mean a single attempt
+	BaseDelay   time.Duration // delay before the first retry, doubled for each further attempt
+	MaxDelay    time.Duration // upper bound for any single delay, including Retry-After; 0 means no bound
+	Jitter      float64       // fraction of each backoff delay that is randomised, from 0 to 1
+}
+
+// DefaultRetryPolicy returns the retry policy used by the command line tool
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// attempts returns the effective maximum number of attempts
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the delay before the given retry (1 for the first retry)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	delay = p.capDelay(delay)
+
+	if p.Jitter > 0 && delay > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(float64(delay) * jitter * rand.Float64())
+	}
+
+	return delay
+}
+
+// capDelay limits a delay to MaxDelay when one is configured
+func (p RetryPolicy) capDelay(delay time.Duration) time.Duration {
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// attemptError is the outcome of a single failed download attempt
+type attemptError struct {
+	err        error
+	category   string
+	statusCode int
+	retryable  bool
+	retryAfter time.Duration // server-requested delay, 0 when absent
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+// isRetryableStatus reports whether an HTTP status is worth retrying.
+// Only server errors and rate limiting qualify; other 4xx responses are final.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// retryDelay decides whether err should be retried and how long to wait first
+func (p RetryPolicy) retryDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt >= p.attempts() {
+		return 0, false
+	}
+
+	var ae *attemptError
+	if !errors.As(err, &ae) || !ae.retryable {
+		return 0, false
+	}
+
+	if ae.retryAfter > 0 {
+		return p.capDelay(ae.retryAfter), true
+	}
+
+	return p.backoff(attempt), true
+}
@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// sniffLen is the number of leading bytes inspected to identify an image
+const sniffLen = 512
+
+// DetectImageType returns the file extension for the image format identified
+// by the leading bytes of data, or "" when no known image signature matches.
+// Recognised formats are JPEG, PNG, GIF, WebP, BMP, TIFF, AVIF, HEIC, SVG and ICO.
+func DetectImageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ".gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return ".webp"
+	case len(data) >= 14 && bytes.HasPrefix(data, []byte("BM")):
+		return ".bmp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return ".tiff"
+	case bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01, 0x00}) && len(data) >= 6 && data[4]|data[5] != 0:
+		return ".ico"
+	}
+
+	if ext := detectISOBMFF(data); ext != "" {
+		return ext
+	}
+
+	if isSVG(data) {
+		return ".svg"
+	}
+
+	return ""
+}
+
+// detectISOBMFF identifies AVIF and HEIC files from the brands in their ftyp box
+func detectISOBMFF(data []byte) string {
+	if len(data) < 16 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return ""
+	}
+
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if size < 16 || size > len(data) {
+		size = len(data)
+	}
+
+	// Major brand at offset 8, compatible brands from offset 16
+	brands := [][]byte{data[8:12]}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, data[i:i+4])
+	}
+
+	for _, brand := range brands {
+		switch string(brand) {
+		case "avif", "avis":
+			return ".avif"
+		}
+	}
+	for _, brand := range brands {
+		switch string(brand) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return ".heic"
+		}
+	}
+
+	return ""
+}
+
+// isSVG reports whether data looks like an SVG document, allowing for a byte
+// order mark, an XML declaration, comments and a doctype before the root element.
+// HTML pages that merely embed an inline <svg> are not matched.
+func isSVG(data []byte) bool {
+	text := bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	text = bytes.TrimLeft(text, " \t\r\n")
+	if !bytes.HasPrefix(text, []byte("<")) {
+		return false
+	}
+
+	lower := bytes.ToLower(text)
+	if bytes.Contains(lower, []byte("<html")) || bytes.Contains(lower, []byte("<!doctype html")) {
+		return false
+	}
+	return bytes.Contains(lower, []byte("<svg"))
+}
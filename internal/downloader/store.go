@@ -0,0 +1,52 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ObjectsDir is the directory, inside a request's Dir, holding the content store
+const ObjectsDir = "objects"
+
+// WithContentStore saves each distinct image once, named by its SHA-256 under
+// Dir/objects/ab/cdef..., and gives every request its file name as a link of
+// the given mode to that object. Identical images from different URLs then
+// take the space of one.
+func WithContentStore(mode LinkMode) Option {
+	return func(d *Downloader) {
+		d.store = mode
+	}
+}
+
+// ObjectPath returns the path of the object with the given hex SHA-256 in the
+// content store of dir
+func ObjectPath(dir, sum string) string {
+	return filepath.Join(dir, ObjectsDir, sum[:2], sum[2:])
+}
+
+// storeObject moves the completed file p into the content store of its
+// request's directory, unless an identical object is already there, and links
+// p's file name to the object
+func (d *Downloader) storeObject(p *partialFile, sum string) (string, error) {
+	outPath := p.outPath
+	object := ObjectPath(p.dir, sum)
+
+	if info, err := os.Stat(object); err == nil && info.Mode().IsRegular() {
+		p.discard()
+	} else {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			p.discard()
+			return "", fmt.Errorf("failed to create directory: %v", err)
+		}
+		p.outPath = object
+		if err := p.commit(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := linkFile(object, outPath, d.store); err != nil {
+		return "", err
+	}
+	return object, nil
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// partialFile is an image being streamed to disk. The data is written to a
+// temporary file in the same directory as outPath and only renamed into place
+// by commit once the whole body has been received, so an interrupted download
+// never leaves a truncated file behind under the final name. Between attempts
+// the temporary file may be kept so the next attempt can resume it.
+type partialFile struct {
+	file    *os.File
+	outPath string
+	dir     string    // directory of the request, which holds the content store
+	written int64     // bytes written so far
+	total   int64     // expected full length, -1 when unknown
+	maxSize int64     // largest accepted length, 0 for no limit
+	hash    hash.Hash // SHA-256 of the data written so far
+	verify  *verifier // nil unless the data must match an expected checksum
+
+	// Response the data came from, needed to resume it with a Range request
+	contentType  string
+	etag         string
+	lastModified string
+	ranges       bool // the server advertised Accept-Ranges: bytes
+}
+
+// createPartial opens a new temporary file for outPath, creating its directory
+func createPartial(outPath string) (*partialFile, error) {
+	dir := filepath.Dir(outPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(outPath)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+
+	return &partialFile{file: tmp, outPath: outPath, total: -1, hash: sha256.New()}, nil
+}
+
+// validator returns the value sent as If-Range when resuming, preferring the
+// strong ETag over Last-Modified. It is empty when the download cannot be
+// resumed safely.
+func (p *partialFile) validator() string {
+	if p.etag != "" && !isWeakETag(p.etag) {
+		return p.etag
+	}
+	return p.lastModified
+}
+
+// copyFrom appends body to the file, failing as soon as the expected or
+// received length exceeds the size limit
+func (p *partialFile) copyFrom(body io.Reader) error {
+	if p.maxSize > 0 && p.total > p.maxSize {
+		return tooLargeError(p.total, p.maxSize)
+	}
+
+	if p.maxSize > 0 {
+		// One byte past the limit is enough to tell the body is too large
+		body = io.LimitReader(body, p.maxSize-p.written+1)
+	}
+	w := io.MultiWriter(p.file, p.hash)
+	if p.verify != nil {
+		w = io.MultiWriter(w, p.verify.hash)
+	}
+	n, err := io.Copy(w, body)
+	p.written += n
+	if p.maxSize > 0 && p.written > p.maxSize {
+		return tooLargeError(p.written, p.maxSize)
+	}
+
+	var rErr *readError
+	if errors.As(err, &rErr) {
+		return readAttemptError(rErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	if p.total >= 0 && p.written != p.total {
+		return &attemptError{
+			err:       fmt.Errorf("incomplete body: received %d of %d bytes", p.written, p.total),
+			category:  CategoryIncomplete,
+			retryable: true,
+		}
+	}
+	return nil
+}
+
+// sum returns the hex SHA-256 of the data written so far
+func (p *partialFile) sum() string {
+	return hex.EncodeToString(p.hash.Sum(nil))
+}
+
+// commit moves the completed file into place under outPath
+func (p *partialFile) commit() error {
+	if err := p.file.Chmod(0644); err != nil {
+		p.discard()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := p.file.Close(); err != nil {
+		p.discard()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := os.Rename(p.file.Name(), p.outPath); err != nil {
+		os.Remove(p.file.Name())
+		return fmt.Errorf("failed to move file into place: %v", err)
+	}
+	return nil
+}
+
+// discard closes and removes the temporary file
+func (p *partialFile) discard() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
@@ -0,0 +1,243 @@
+package naming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sbleks/go-get-imgs/internal/csv"
+)
+
+// DefaultTemplate reproduces the original image_<row><ext> file names
+const DefaultTemplate = "image_{row}{ext}"
+
+// defaultHashLength is the number of hex characters used by {urlhash}
+const defaultHashLength = 12
+
+var rowFormat = regexp.MustCompile(`^0?[0-9]*d$`)
+
+// Template renders output file names from a pattern such as
+// "{col:sku}_{col:angle}{ext}" or "{row:05d}-{urlbase}{ext}".
+//
+// Supported placeholders:
+//
+//	{row}, {row:05d}    CSV row number, optionally printf-formatted
+//	{col:NAME}, {col:N} value of a CSV column by header name or 1-based index
+//	{urlbase}           last path segment of the URL without its extension
+//	{urlhash}, {urlhash:N} first 12 (or N) hex characters of the URL's SHA-256
+//	{ext}               detected file extension including the leading dot
+//
+// Substituted values are sanitised so they cannot introduce path separators or
+// characters that are illegal in file names. Literal "/" in the pattern creates
+// subdirectories.
+type Template struct {
+	pattern string
+	parts   []part
+}
+
+// part is either literal text or a placeholder
+type part struct {
+	literal string
+	kind    string // "", "row", "col", "urlbase", "urlhash" or "ext"
+	arg     string
+}
+
+// Data is the per-row input for rendering a file name
+type Data struct {
+	Row    int
+	URL    string
+	Ext    string
+	Header []string
+	Record []string
+}
+
+// Parse parses a file name template
+func Parse(pattern string) (*Template, error) {
+	t := &Template{pattern: pattern}
+
+	rest := pattern
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, part{literal: rest[:start]})
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("name template %q: unclosed placeholder", pattern)
+		}
+
+		p, err := parsePlaceholder(rest[start+1 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("name template %q: %v", pattern, err)
+		}
+		t.parts = append(t.parts, p)
+		rest = rest[start+end+1:]
+	}
+
+	for _, p := range t.parts {
+		if strings.Contains(p.literal, "}") {
+			return nil, fmt.Errorf("name template %q: unbalanced braces", pattern)
+		}
+	}
+
+	return t, nil
+}
+
+func parsePlaceholder(s string) (part, error) {
+	kind, arg, hasArg := strings.Cut(s, ":")
+
+	switch kind {
+	case "row":
+		if hasArg && !rowFormat.MatchString(arg) {
+			return part{}, fmt.Errorf("invalid row format %q, expected e.g. {row:05d}", arg)
+		}
+	case "col":
+		if strings.TrimSpace(arg) == "" {
+			return part{}, fmt.Errorf("{col:...} needs a column name or index")
+		}
+	case "urlhash":
+		if hasArg {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > sha256.Size*2 {
+				return part{}, fmt.Errorf("invalid urlhash length %q", arg)
+			}
+		}
+	case "urlbase", "ext":
+		if hasArg {
+			return part{}, fmt.Errorf("{%s} takes no argument", kind)
+		}
+	default:
+		return part{}, fmt.Errorf("unknown placeholder {%s}", s)
+	}
+
+	return part{kind: kind, arg: arg}, nil
+}
+
+// String returns the template pattern
+func (t *Template) String() string {
+	return t.pattern
+}
+
+// Validate checks that every column referenced by the template exists in header
+func (t *Template) Validate(header []string) error {
+	for _, p := range t.parts {
+		if p.kind != "col" {
+			continue
+		}
+		if _, err := csv.ResolveColumn(header, p.arg); err != nil {
+			return fmt.Errorf("name template %q: %v", t.pattern, err)
+		}
+	}
+	return nil
+}
+
+// Render produces the relative file name for a row
+func (t *Template) Render(data Data) (string, error) {
+	var b strings.Builder
+
+	for _, p := range t.parts {
+		switch p.kind {
+		case "":
+			b.WriteString(p.literal)
+		case "row":
+			if p.arg == "" {
+				b.WriteString(strconv.Itoa(data.Row))
+			} else {
+				b.WriteString(fmt.Sprintf("%"+p.arg, data.Row))
+			}
+		case "col":
+			index, err := csv.ResolveColumn(data.Header, p.arg)
+			if err != nil {
+				return "", err
+			}
+			value := ""
+			if index <= len(data.Record) {
+				value = strings.TrimSpace(data.Record[index-1])
+			}
+			b.WriteString(Sanitize(value))
+		case "urlbase":
+			b.WriteString(Sanitize(urlBase(data.URL)))
+		case "urlhash":
+			length := defaultHashLength
+			if p.arg != "" {
+				length, _ = strconv.Atoi(p.arg)
+			}
+			sum := sha256.Sum256([]byte(data.URL))
+			b.WriteString(hex.EncodeToString(sum[:])[:length])
+		case "ext":
+			b.WriteString(Sanitize(data.Ext))
+		}
+	}
+
+	name := filepath.FromSlash(b.String())
+	base := strings.TrimSuffix(filepath.Base(name), data.Ext)
+	if base == "" || base == "." {
+		return "", fmt.Errorf("name template %q produced an empty file name for row %d", t.pattern, data.Row)
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("name template %q produced %q, which is outside the output directory", t.pattern, name)
+	}
+
+	return name, nil
+}
+
+// urlBase returns the last path segment of a URL without its extension
+func urlBase(rawURL string) string {
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		p = u.Path
+	}
+
+	base := path.Base(p)
+	if base == "." || base == "/" {
+		return ""
+	}
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// reservedNames are device names Windows refuses as file names
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sanitize makes a value safe to embed in a file name on any supported platform.
+// Path separators, characters illegal on Windows and control characters become
+// underscores, trailing dots and spaces are dropped and reserved device names
+// are prefixed with an underscore.
+func Sanitize(value string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return '_'
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		default:
+			return r
+		}
+	}, value)
+
+	cleaned = strings.TrimRight(cleaned, ". ")
+	if cleaned == "" && value != "" {
+		return "_"
+	}
+
+	stem, _, _ := strings.Cut(cleaned, ".")
+	if reservedNames[strings.ToUpper(stem)] {
+		cleaned = "_" + cleaned
+	}
+
+	return cleaned
+}
@@ -0,0 +1,71 @@
+package report
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ManifestFileName is the name of the manifest written to the output directory
+const ManifestFileName = "manifest.csv"
+
+// WriteManifest writes a CSV mapping each row with a saved file to the SHA-256
+// of its content and its path relative to outDir, with the columns
+// row,url,sha256,path. Rows recorded without a hash, such as skipped or
+// unchanged ones, are hashed from the file on disk.
+func (r *Report) WriteManifest(path, outDir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"row", "url", "sha256", "path"})
+	for _, row := range r.Rows {
+		if row.Path == "" || (row.Status != StatusSucceeded && row.Status != StatusSkipped) {
+			continue
+		}
+
+		sum := row.SHA256
+		if sum == "" {
+			var err error
+			if sum, err = fileSHA256(row.Path); err != nil {
+				return fmt.Errorf("failed to hash row %d: %v", row.Row, err)
+			}
+		}
+		rel, err := filepath.Rel(outDir, row.Path)
+		if err != nil {
+			rel = row.Path
+		}
+		w.Write([]string{strconv.Itoa(row.Row), row.URL, sum, filepath.ToSlash(rel)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
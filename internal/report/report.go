@@ -0,0 +1,217 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sbleks/go-get-imgs/internal/csv"
+)
+
+// Row status values
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+)
+
+// Report is the machine-readable record of a download run
+type Report struct {
+	Version      string    `json:"version"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	CSVPath      string    `json:"csv_path"`
+	Column       string    `json:"column"`
+	OutDir       string    `json:"out_dir"`
+	NameTemplate string    `json:"name_template"`
+	Retries      int       `json:"retries,omitempty"`
+	Totals       Totals    `json:"totals"`
+	Rows         []Row     `json:"rows"`
+
+	mu sync.Mutex
+}
+
+// Totals aggregates the outcome of a run
+type Totals struct {
+	TotalRows  int   `json:"total_rows"`
+	Succeeded  int   `json:"succeeded"`
+	Failed     int   `json:"failed"`
+	Skipped    int   `json:"skipped"`
+	Bytes      int64 `json:"bytes"`
+	DurationMs int64 `json:"duration_ms"`
+	Throughput int64 `json:"bytes_per_second"` // bytes downloaded per second of run time
+	Canceled   bool  `json:"canceled,omitempty"`
+}
+
+// Row is the outcome of a single CSV row
+type Row struct {
+	Row         int      `json:"row"`
+	URL         string   `json:"url,omitempty"`
+	Status      string   `json:"status"`
+	HTTPStatus  int      `json:"http_status,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Bytes       int64    `json:"bytes"`
+	DurationMs  int64    `json:"duration_ms"`
+	Throughput  int64    `json:"bytes_per_second,omitempty"` // bytes per second of the row's download time
+	Path        string   `json:"path,omitempty"`
+	SHA256      string   `json:"sha256,omitempty"` // hex SHA-256 of the downloaded image
+	Attempts    int      `json:"attempts,omitempty"`
+	SharedFrom  int      `json:"shared_from,omitempty"` // row whose download of the same URL this row reused
+	Redirects   []string `json:"redirects,omitempty"`   // redirect targets, in order
+	FinalURL    string   `json:"final_url,omitempty"`   // URL the image was fetched from, when redirected
+	Category    string   `json:"category,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// New starts a report for a run beginning now
+func New(version, csvPath, column, outDir, nameTemplate string) *Report {
+	return &Report{
+		Version:      version,
+		StartTime:    time.Now().UTC(),
+		CSVPath:      csvPath,
+		Column:       column,
+		OutDir:       outDir,
+		NameTemplate: nameTemplate,
+	}
+}
+
+// Load reads a report previously written by Write
+func Load(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %v", err)
+	}
+
+	r := &Report{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse report %s: %v", path, err)
+	}
+
+	return r, nil
+}
+
+// Add records the outcome of a row. It is safe for concurrent use.
+func (r *Report) Add(row Row) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Rows = append(r.Rows, row)
+}
+
+// Finish adds the rows the processor rejected before download, such as short
+// rows and empty cells, then orders the rows and computes the totals
+func (r *Report) Finish(result *csv.ProcessResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.EndTime = time.Now().UTC()
+
+	recorded := make(map[int]bool, len(r.Rows))
+	for _, row := range r.Rows {
+		recorded[row.Row] = true
+	}
+	for _, f := range result.Failures {
+		if !recorded[f.Row] {
+			r.Rows = append(r.Rows, Row{Row: f.Row, URL: f.URL, Status: StatusFailed, Category: f.Category, Error: f.Message})
+		}
+	}
+
+	r.Totals = Totals{
+		TotalRows:  result.TotalRows,
+		DurationMs: r.EndTime.Sub(r.StartTime).Milliseconds(),
+		Canceled:   result.Canceled,
+	}
+	r.tally()
+}
+
+// FailedRows returns the numbers of the rows whose status is failed
+func (r *Report) FailedRows() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rows []int
+	for _, row := range r.Rows {
+		if row.Status == StatusFailed {
+			rows = append(rows, row.Row)
+		}
+	}
+	return rows
+}
+
+// Merge replaces the rows of r with the outcomes recorded by a finished retry
+// run, keyed by row number, and recomputes the totals. The total row count is
+// kept from r since a retry only covers part of the file.
+func (r *Report) Merge(retry *Report) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := make(map[int]int, len(r.Rows))
+	for i, row := range r.Rows {
+		index[row.Row] = i
+	}
+	for _, row := range retry.Rows {
+		if i, ok := index[row.Row]; ok {
+			r.Rows[i] = row
+		} else {
+			r.Rows = append(r.Rows, row)
+		}
+	}
+
+	r.Version = retry.Version
+	r.EndTime = retry.EndTime
+	r.Retries++
+	r.Totals = Totals{
+		TotalRows:  r.Totals.TotalRows,
+		DurationMs: r.Totals.DurationMs + retry.Totals.DurationMs,
+		Canceled:   retry.Totals.Canceled,
+	}
+	r.tally()
+}
+
+// tally orders the rows and counts them into the totals. Callers hold r.mu.
+func (r *Report) tally() {
+	sort.Slice(r.Rows, func(i, j int) bool {
+		return r.Rows[i].Row < r.Rows[j].Row
+	})
+
+	r.Totals.Succeeded, r.Totals.Failed, r.Totals.Skipped, r.Totals.Bytes = 0, 0, 0, 0
+	for _, row := range r.Rows {
+		switch row.Status {
+		case StatusSucceeded:
+			r.Totals.Succeeded++
+		case StatusFailed:
+			r.Totals.Failed++
+		case StatusSkipped:
+			r.Totals.Skipped++
+		}
+		r.Totals.Bytes += row.Bytes
+	}
+	r.Totals.Throughput = Throughput(r.Totals.Bytes, time.Duration(r.Totals.DurationMs)*time.Millisecond)
+}
+
+// Throughput returns the rate in bytes per second of n bytes transferred in d
+func Throughput(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// Write saves the report as indented JSON
+func (r *Report) Write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+
+	return nil
+}
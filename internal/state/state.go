@@ -0,0 +1,194 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileName is the name of the state file kept in the downloads directory
+const FileName = ".go-get-imgs-state.json"
+
+// Row status values
+const (
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// saveInterval bounds how often row updates are flushed to disk
+const saveInterval = 2 * time.Second
+
+// RowState records the outcome of a single CSV row
+type RowState struct {
+	Status    string    `json:"status"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// HTTP validators of the saved file, sent as If-None-Match and
+	// If-Modified-Since when the row is synced again
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// State tracks per-row progress of a download job so an interrupted run can be resumed
+type State struct {
+	CSVPath   string            `json:"csv_path"`
+	CSVSHA256 string            `json:"csv_sha256"`
+	Column    string            `json:"column"`
+	Rows      map[int]*RowState `json:"rows"`
+
+	path     string
+	mu       sync.Mutex
+	lastSave time.Time
+}
+
+// New creates an empty state that will be saved to path
+func New(path, csvPath, csvHash, column string) *State {
+	return &State{
+		CSVPath:   csvPath,
+		CSVSHA256: csvHash,
+		Column:    column,
+		Rows:      make(map[int]*RowState),
+		path:      path,
+	}
+}
+
+// Load reads a state file previously written by Save
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	if s.Rows == nil {
+		s.Rows = make(map[int]*RowState)
+	}
+	s.path = path
+
+	return s, nil
+}
+
+// HashFile returns the hex-encoded SHA-256 of a file's contents
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Matches reports whether the state was recorded for the same CSV content and column.
+// A non-nil error explains the mismatch.
+func (s *State) Matches(csvHash, column string) error {
+	if s.CSVSHA256 != csvHash {
+		return fmt.Errorf("CSV file %s has changed since the state was recorded", s.CSVPath)
+	}
+	if s.Column != column {
+		return fmt.Errorf("state was recorded for column %q, not %q", s.Column, column)
+	}
+	return nil
+}
+
+// Completed returns the recorded row when it was downloaded from the same URL
+// and its file is still on disk
+func (s *State) Completed(rowNum int, url string) (*RowState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.Rows[rowNum]
+	if !ok || row.Status != StatusCompleted || row.URL != url || row.Path == "" {
+		return nil, false
+	}
+	if _, err := os.Stat(row.Path); err != nil {
+		return nil, false
+	}
+
+	copied := *row
+	return &copied, true
+}
+
+// MarkCompleted records a successful download, saving the state when due
+func (s *State) MarkCompleted(rowNum int, url, path string) error {
+	return s.MarkCompletedWithValidators(rowNum, url, path, "", "")
+}
+
+// MarkCompletedWithValidators records a successful download together with the
+// ETag and Last-Modified headers it was served with, saving the state when due
+func (s *State) MarkCompletedWithValidators(rowNum int, url, path, etag, lastModified string) error {
+	return s.update(rowNum, &RowState{Status: StatusCompleted, URL: url, Path: path, ETag: etag, LastModified: lastModified})
+}
+
+// MarkFailed records a failed download, saving the state when due
+func (s *State) MarkFailed(rowNum int, url string, err error) error {
+	return s.update(rowNum, &RowState{Status: StatusFailed, URL: url, Error: err.Error()})
+}
+
+func (s *State) update(rowNum int, row *RowState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row.UpdatedAt = time.Now().UTC()
+	s.Rows[rowNum] = row
+
+	if time.Since(s.lastSave) < saveInterval {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// Save writes the state file atomically
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+func (s *State) saveLocked() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	s.lastSave = time.Now()
+	return nil
+}
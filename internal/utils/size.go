@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps size suffixes to their multipliers. KB, MB and GB are
+// decimal; KiB, MiB and GiB are binary.
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// ParseByteSize parses a size such as "512", "200KB", "1.5MiB" or "5MB/s"
+// into a number of bytes. A trailing "/s" is accepted so rates read naturally.
+func ParseByteSize(s string) (int64, error) {
+	text := strings.TrimSpace(s)
+	text = strings.TrimSuffix(text, "/s")
+
+	i := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(text)
+	}
+
+	value, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(text[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q; use B, KB, MB, GB, KiB, MiB or GiB", s, text[i:])
+	}
+
+	return int64(value * unit), nil
+}
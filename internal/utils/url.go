@@ -1,6 +1,12 @@
 package utils
 
-import "strings"
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
 
 // IsValidURL checks if a string is a valid URL with a supported scheme
 func IsValidURL(url string) bool {
@@ -9,11 +15,17 @@ func IsValidURL(url string) bool {
 		return false
 	}
 
-	// Check for supported URL schemes
+	// data: URIs embed the image itself after a comma
+	if len(trimmed) > 5 && strings.EqualFold(trimmed[:5], "data:") {
+		return strings.Contains(trimmed, ",")
+	}
+
+	// Check for supported URL schemes, which are case-insensitive
+	lower := strings.ToLower(trimmed)
 	validSchemes := []string{"http://", "https://", "ftp://", "file://"}
 	hasValidScheme := false
 	for _, scheme := range validSchemes {
-		if strings.HasPrefix(trimmed, scheme) {
+		if strings.HasPrefix(lower, scheme) {
 			hasValidScheme = true
 			break
 		}
@@ -24,7 +36,7 @@ func IsValidURL(url string) bool {
 	}
 
 	// For file:// URLs, check if there's a path after the scheme
-	if strings.HasPrefix(trimmed, "file://") {
+	if strings.HasPrefix(lower, "file://") {
 		// file:// URLs should have at least a path (e.g., file:///path)
 		return len(trimmed) > 7
 	}
@@ -32,7 +44,7 @@ func IsValidURL(url string) bool {
 	// For other schemes, check if there's a domain after the scheme
 	// Remove the scheme and check if there's content after it
 	for _, scheme := range validSchemes {
-		if strings.HasPrefix(trimmed, scheme) {
+		if strings.HasPrefix(lower, scheme) {
 			afterScheme := trimmed[len(scheme):]
 			// Should have at least a domain (e.g., example.com)
 			return len(afterScheme) > 0 && !strings.Contains(afterScheme, " ")
@@ -41,3 +53,60 @@ func IsValidURL(url string) bool {
 
 	return false
 }
+
+// maxDisplayLen bounds how much of a data: URI DisplayURL shows
+const maxDisplayLen = 60
+
+// DisplayURL shortens data: URIs, which can run to megabytes, for progress
+// and error messages. Other URLs are returned unchanged.
+func DisplayURL(url string) string {
+	if len(url) <= maxDisplayLen || !strings.HasPrefix(strings.ToLower(url), "data:") {
+		return url
+	}
+	return fmt.Sprintf("%s... (%d bytes)", url[:maxDisplayLen], len(url))
+}
+
+// RecordedURL returns the form of url kept in state files, reports and error
+// files. data: URIs longer than DisplayURL shows are shortened like it and
+// identified by their SHA-256, so rows can still be compared without storing
+// the whole image. Other URLs are returned unchanged.
+func RecordedURL(url string) string {
+	if len(url) <= maxDisplayLen || !strings.HasPrefix(strings.ToLower(url), "data:") {
+		return url
+	}
+	return fmt.Sprintf("%s... (%d bytes, sha256 %x)", url[:maxDisplayLen], len(url), sha256.Sum256([]byte(url)))
+}
+
+// defaultPorts are the ports NormalizeURL drops
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ftp": "21"}
+
+// NormalizeURL returns a form of raw under which URLs fetching the same
+// resource compare equal: the scheme and host are lower-cased, a default port
+// and the fragment are dropped, and an empty HTTP path becomes "/". The path
+// and query are kept as they are, since servers may treat them case-sensitively.
+// Strings that do not parse are returned trimmed but otherwise unchanged.
+func NormalizeURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Opaque != "" {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := u.Hostname(), u.Port()
+	host = strings.ToLower(host)
+	if port == "" || port == defaultPorts[u.Scheme] {
+		u.Host = host
+		if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		}
+	} else {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if u.Path == "" && (u.Scheme == "http" || u.Scheme == "https") {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	csvpkg "github.com/sbleks/go-get-imgs/internal/csv"
 	"github.com/sbleks/go-get-imgs/internal/downloader"
+	"github.com/sbleks/go-get-imgs/internal/naming"
+	"github.com/sbleks/go-get-imgs/internal/report"
+	"github.com/sbleks/go-get-imgs/internal/state"
 	"github.com/sbleks/go-get-imgs/internal/utils"
 )
 
@@ -393,3 +401,533 @@ func TestIntegrationLargeFile(t *testing.T) {
 		}
 	}
 }
+
+// TestIntegrationConcurrentWorkers tests that a worker pool keeps row numbering deterministic
+func TestIntegrationConcurrentWorkers(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var inFlight, maxInFlight int32
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+				break
+			}
+		}
+
+		// Make later rows finish first so completion order differs from row order
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/image"))
+		time.Sleep(time.Duration(20-id) * time.Millisecond)
+
+		w.Header().Set("Content-Type", "image/png")
+		if _, err := w.Write([]byte(r.URL.Path)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+
+	csvFile := th.CreateTestCSVWithURLs("concurrent_workers_test.csv", server.URL, 20)
+	downloadDir := th.CreateTestDirectory("concurrent_workers_downloads")
+
+	processor := csvpkg.NewProcessor(csvpkg.WithWorkers(5))
+	d := downloader.NewDownloader(30 * time.Second)
+
+	result, err := processor.ProcessCSV(csvFile, 3, func(url string, rowNum int) error {
+		return d.DownloadImage(url, downloadDir, rowNum)
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	if result.SuccessCount != 20 || result.ErrorCount != 0 || result.TotalRows != 20 {
+		t.Errorf("Expected 20/0/20 success/error/total, got %d/%d/%d", result.SuccessCount, result.ErrorCount, result.TotalRows)
+	}
+
+	if maxInFlight < 2 {
+		t.Errorf("Expected concurrent downloads, max in flight was %d", maxInFlight)
+	}
+
+	for i := 1; i <= 20; i++ {
+		data, err := os.ReadFile(filepath.Join(downloadDir, fmt.Sprintf("image_%d.png", i)))
+		if err != nil {
+			t.Errorf("Row %d: %v", i, err)
+			continue
+		}
+		if string(data) != fmt.Sprintf("/image%d", i) {
+			t.Errorf("Row %d: expected content for /image%d, got %q", i, i, data)
+		}
+	}
+}
+
+// TestIntegrationRowFailures tests that failed rows are reported with their category
+func TestIntegrationRowFailures(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if _, err := w.Write([]byte("success image")); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+
+	csvFile := th.CreateTestCSV("row_failures_test.csv", fmt.Sprintf(`id,name,image_url
+1,Good,%s/ok
+2,Missing,%s/missing
+3,Invalid,invalid-url
+4,Empty,
+5,Short`, server.URL, server.URL))
+	downloadDir := th.CreateTestDirectory("row_failures_downloads")
+
+	d := downloader.NewDownloader(30 * time.Second)
+	result, err := csvpkg.NewProcessor(csvpkg.WithWorkers(3)).ProcessCSVColumn(csvFile, "image_url", func(url string, rowNum int) error {
+		if !utils.IsValidURL(url) {
+			return downloader.InvalidURLError(url)
+		}
+		return d.DownloadImage(url, downloadDir, rowNum)
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	expected := []struct {
+		row      int
+		category string
+	}{
+		{2, downloader.CategoryHTTPStatus},
+		{3, downloader.CategoryInvalidURL},
+		{4, csvpkg.CategoryEmptyCell},
+		{5, csvpkg.CategoryShortRow},
+	}
+
+	if result.ErrorCount != len(expected) || len(result.Failures) != len(expected) {
+		t.Fatalf("Expected %d failures, got count %d and %v", len(expected), result.ErrorCount, result.Failures)
+	}
+
+	for i, exp := range expected {
+		f := result.Failures[i]
+		if f.Row != exp.row || f.Category != exp.category || f.Message == "" {
+			t.Errorf("Failure %d: expected row %d [%s], got %+v", i, exp.row, exp.category, f)
+		}
+	}
+
+	if result.Failures[0].URL != server.URL+"/missing" {
+		t.Errorf("Expected failure URL %s/missing, got %s", server.URL, result.Failures[0].URL)
+	}
+
+	errorsFile := filepath.Join(downloadDir, "errors.csv")
+	if err := csvpkg.WriteFailures(errorsFile, result.Failures); err != nil {
+		t.Fatalf("Failed to write failures: %v", err)
+	}
+
+	file, err := os.Open(errorsFile)
+	if err != nil {
+		t.Fatalf("Failed to open failures file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read failures file: %v", err)
+	}
+	if len(records) != len(expected)+1 || records[2][2] != downloader.CategoryInvalidURL {
+		t.Errorf("Unexpected failures file contents: %v", records)
+	}
+}
+
+// TestIntegrationResumeFromState tests that a resumed run skips completed rows and retries failed ones
+func TestIntegrationResumeFromState(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	failRow2 := true
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		fail := failRow2 && r.URL.Path == "/image2"
+		mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if _, err := w.Write([]byte("resumable image")); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+
+	csvFile := th.CreateTestCSVWithURLs("resume_state_test.csv", server.URL, 3)
+	downloadDir := th.CreateTestDirectory("resume_state_downloads")
+	statePath := filepath.Join(downloadDir, state.FileName)
+
+	csvHash, err := state.HashFile(csvFile)
+	if err != nil {
+		t.Fatalf("Failed to hash CSV file: %v", err)
+	}
+
+	d := downloader.NewDownloader(30 * time.Second)
+	run := func(st *state.State) *csvpkg.ProcessResult {
+		result, err := csvpkg.NewProcessor(csvpkg.WithWorkers(2)).ProcessCSVColumn(csvFile, "image_url", func(url string, rowNum int) error {
+			if _, done := st.Completed(rowNum, url); done {
+				return nil
+			}
+			res, err := d.Download(context.Background(), downloader.Request{URL: url, Dir: downloadDir, RowNum: rowNum})
+			if err != nil {
+				return st.MarkFailed(rowNum, url, err)
+			}
+			return st.MarkCompleted(rowNum, url, res.Path)
+		})
+		if err != nil {
+			t.Fatalf("Failed to process CSV file: %v", err)
+		}
+		if err := st.Save(); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+		return result
+	}
+
+	// First run: row 2 fails
+	run(state.New(statePath, csvFile, csvHash, "image_url"))
+
+	// Second run resumes from the saved state once the server recovers
+	mu.Lock()
+	failRow2 = false
+	mu.Unlock()
+
+	st, err := state.Load(statePath)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if err := st.Matches(csvHash, "image_url"); err != nil {
+		t.Fatalf("Expected state to match CSV: %v", err)
+	}
+	if st.Rows[2] == nil || st.Rows[2].Status != state.StatusFailed {
+		t.Errorf("Expected row 2 to be recorded as failed, got %+v", st.Rows[2])
+	}
+
+	run(st)
+
+	if requests["/image1"] != 1 || requests["/image3"] != 1 {
+		t.Errorf("Expected completed rows not to be downloaded again, got %v", requests)
+	}
+	if requests["/image2"] != 2 {
+		t.Errorf("Expected failed row to be retried, got %v", requests)
+	}
+	th.AssertFilesExist(downloadDir, []string{"image_1.jpg", "image_2.jpg", "image_3.jpg"})
+
+	// A changed CSV is detected
+	if err := os.WriteFile(csvFile, []byte("id,name,image_url\n1,Changed,"+server.URL+"/other\n"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite CSV file: %v", err)
+	}
+	changedHash, err := state.HashFile(csvFile)
+	if err != nil {
+		t.Fatalf("Failed to hash CSV file: %v", err)
+	}
+	if err := st.Matches(changedHash, "image_url"); err == nil {
+		t.Error("Expected changed CSV to be detected")
+	}
+}
+
+// TestIntegrationCancellation tests that canceling the context stops dispatching rows and aborts downloads cleanly
+func TestIntegrationCancellation(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	started := make(chan struct{}, 10)
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", "1000")
+		if _, err := w.Write([]byte("\xFF\xD8\xFF partial")); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+
+		// Stall mid-body until the client gives up
+		<-r.Context().Done()
+	}))
+
+	csvFile := th.CreateTestCSVWithURLs("cancellation_test.csv", server.URL, 50)
+	downloadDir := th.CreateTestDirectory("cancellation_downloads")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+
+	d := downloader.NewDownloader(30*time.Second, downloader.WithRetryPolicy(downloader.DefaultRetryPolicy()))
+	result, err := csvpkg.NewProcessor(csvpkg.WithWorkers(2)).ProcessRows(ctx, csvFile, "image_url", func(ctx context.Context, row csvpkg.Row) error {
+		_, err := d.Download(ctx, downloader.Request{URL: row.URL, Dir: downloadDir, RowNum: row.Num})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	if !result.Canceled {
+		t.Error("Expected result to be marked as canceled")
+	}
+	if result.TotalRows >= 50 {
+		t.Errorf("Expected dispatching to stop early, processed %d rows", result.TotalRows)
+	}
+	if result.SuccessCount != 0 || len(result.Failures) == 0 {
+		t.Fatalf("Expected only canceled rows, got %d successes and %v", result.SuccessCount, result.Failures)
+	}
+	for _, f := range result.Failures {
+		if f.Category != downloader.CategoryCanceled {
+			t.Errorf("Row %d: expected canceled category, got %s (%s)", f.Row, f.Category, f.Message)
+		}
+	}
+
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to read download directory: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Expected no files after canceled downloads, found %s", entry.Name())
+	}
+}
+
+// TestIntegrationRunReport tests building and writing the JSON run report
+func TestIntegrationRunReport(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nreport image")
+	}))
+
+	csvFile := th.CreateTestCSV("run_report_test.csv", fmt.Sprintf(`id,name,image_url
+1,First,%s/image1
+2,Second,%s/image2
+3,Third,`, server.URL, server.URL))
+	downloadDir := th.CreateTestDirectory("run_report_downloads")
+
+	runReport := report.New("test", csvFile, "image_url", downloadDir, naming.DefaultTemplate)
+	d := downloader.NewDownloader(30 * time.Second)
+
+	result, err := csvpkg.NewProcessor().ProcessRows(context.Background(), csvFile, "image_url", func(ctx context.Context, row csvpkg.Row) error {
+		res, err := d.Download(ctx, downloader.Request{URL: row.URL, Dir: downloadDir, RowNum: row.Num})
+		if err != nil {
+			rowErr := csvpkg.NewRowError(row.Num, row.URL, err)
+			runReport.Add(report.Row{Row: row.Num, URL: row.URL, Status: report.StatusFailed, Category: rowErr.Category, Error: rowErr.Message})
+			return err
+		}
+		runReport.Add(report.Row{
+			Row:         row.Num,
+			URL:         row.URL,
+			Status:      report.StatusSucceeded,
+			HTTPStatus:  res.StatusCode,
+			ContentType: res.ContentType,
+			Bytes:       res.Bytes,
+			Path:        res.Path,
+			Attempts:    res.Attempts,
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	runReport.Finish(result)
+	reportFile := filepath.Join(downloadDir, "report.json")
+	if err := runReport.Write(reportFile); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	loaded, err := report.Load(reportFile)
+	if err != nil {
+		t.Fatalf("Failed to load report: %v", err)
+	}
+
+	if loaded.Version != "test" || loaded.CSVPath != csvFile || loaded.Column != "image_url" || loaded.EndTime.Before(loaded.StartTime) {
+		t.Errorf("Unexpected report metadata: %+v", loaded)
+	}
+
+	expectedTotals := report.Totals{TotalRows: 3, Succeeded: 1, Failed: 2, Bytes: int64(len("\x89PNG\r\n\x1a\nreport image"))}
+	if want := loaded.Totals.Bytes * 1000 / max(loaded.Totals.DurationMs, 1); loaded.Totals.DurationMs > 0 && (loaded.Totals.Throughput < want-1 || loaded.Totals.Throughput > want+1) {
+		t.Errorf("Expected throughput to match bytes over duration, got %+v", loaded.Totals)
+	}
+	loaded.Totals.DurationMs, loaded.Totals.Throughput = 0, 0
+	if loaded.Totals != expectedTotals {
+		t.Errorf("Expected totals %+v, got %+v", expectedTotals, loaded.Totals)
+	}
+
+	if len(loaded.Rows) != 3 {
+		t.Fatalf("Expected 3 report rows, got %d", len(loaded.Rows))
+	}
+	first, second, third := loaded.Rows[0], loaded.Rows[1], loaded.Rows[2]
+	if first.Status != report.StatusSucceeded || first.HTTPStatus != http.StatusOK || first.ContentType != "image/png" || first.Path != filepath.Join(downloadDir, "image_1.png") || first.Attempts != 1 {
+		t.Errorf("Unexpected first row: %+v", first)
+	}
+	if second.Status != report.StatusFailed || second.Category != downloader.CategoryHTTPStatus {
+		t.Errorf("Unexpected second row: %+v", second)
+	}
+	if third.Status != report.StatusFailed || third.Category != csvpkg.CategoryEmptyCell {
+		t.Errorf("Unexpected third row: %+v", third)
+	}
+}
+
+// TestIntegrationRetryFailedRows tests re-processing only the failed rows of
+// a report and merging the outcome back into it
+func TestIntegrationRetryFailedRows(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var healed atomic.Bool
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image3" && !healed.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nretry image")
+	}))
+
+	csvFile := th.CreateTestCSV("retry_test.csv", fmt.Sprintf(`id,image_url
+1,%s/image1
+2,
+3,%s/image3
+4,%s/image4`, server.URL, server.URL, server.URL))
+	downloadDir := th.CreateTestDirectory("retry_downloads")
+	d := downloader.NewDownloader(30*time.Second, downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 1}))
+
+	run := func(processor *csvpkg.Processor, r *report.Report) (*csvpkg.ProcessResult, []int) {
+		var mu sync.Mutex
+		var seen []int
+		result, err := processor.ProcessRows(context.Background(), csvFile, "image_url", func(ctx context.Context, row csvpkg.Row) error {
+			mu.Lock()
+			seen = append(seen, row.Num)
+			mu.Unlock()
+
+			res, err := d.Download(ctx, downloader.Request{URL: row.URL, Dir: downloadDir, RowNum: row.Num})
+			if err != nil {
+				rowErr := csvpkg.NewRowError(row.Num, row.URL, err)
+				r.Add(report.Row{Row: row.Num, URL: row.URL, Status: report.StatusFailed, Category: rowErr.Category, Error: rowErr.Message})
+				return err
+			}
+			r.Add(report.Row{Row: row.Num, URL: row.URL, Status: report.StatusSucceeded, Bytes: res.Bytes, Path: res.Path})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to process CSV file: %v", err)
+		}
+		r.Finish(result)
+		return result, seen
+	}
+
+	original := report.New("test", csvFile, "image_url", downloadDir, naming.DefaultTemplate)
+	run(csvpkg.NewProcessor(), original)
+
+	failed := original.FailedRows()
+	if len(failed) != 2 || failed[0] != 2 || failed[1] != 3 {
+		t.Fatalf("Expected failed rows [2 3], got %v", failed)
+	}
+
+	healed.Store(true)
+	retry := report.New("test", csvFile, "image_url", downloadDir, naming.DefaultTemplate)
+	result, seen := run(csvpkg.NewProcessor(csvpkg.WithRows(failed)), retry)
+
+	// Only row 3 reaches the callback; row 2 is still an empty cell
+	if len(seen) != 1 || seen[0] != 3 {
+		t.Errorf("Expected only row 3 to be downloaded, got %v", seen)
+	}
+	if result.TotalRows != 2 || result.SuccessCount != 1 || result.ErrorCount != 1 {
+		t.Errorf("Unexpected retry result: %+v", result)
+	}
+	th.AssertFilesExist(downloadDir, []string{"image_3.png"})
+
+	original.Merge(retry)
+	if original.Retries != 1 {
+		t.Errorf("Expected 1 retry, got %d", original.Retries)
+	}
+	if original.Totals.TotalRows != 4 || original.Totals.Succeeded != 3 || original.Totals.Failed != 1 {
+		t.Errorf("Unexpected merged totals: %+v", original.Totals)
+	}
+	if len(original.Rows) != 4 {
+		t.Fatalf("Expected 4 merged rows, got %d", len(original.Rows))
+	}
+	if row := original.Rows[2]; row.Row != 3 || row.Status != report.StatusSucceeded || row.Path != filepath.Join(downloadDir, "image_3.png") {
+		t.Errorf("Unexpected merged row 3: %+v", row)
+	}
+	if row := original.Rows[1]; row.Row != 2 || row.Category != csvpkg.CategoryEmptyCell {
+		t.Errorf("Unexpected merged row 2: %+v", row)
+	}
+}
+
+// TestIntegrationDedupeNormalizedURLs tests that rows whose URLs differ only
+// in scheme and host case, default port or fragment pass URL validation and
+// share a single download, as with --dedupe
+func TestIntegrationDedupeNormalizedURLs(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var requests atomic.Int32
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nshared image")
+	}))
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	csvFile := th.CreateTestCSV("dedupe_test.csv", fmt.Sprintf(`sku,image_url
+a,http://localhost:%s/a.png
+b,HTTP://LocalHost:%s/a.png#zoom
+c,Http://LOCALHOST:%s/a.png`, port, port, port))
+	downloadDir := th.CreateTestDirectory("dedupe_downloads")
+	d := downloader.NewDownloader(30 * time.Second)
+
+	// Rows are processed in order, so the first one downloads and the others link
+	var mu sync.Mutex
+	saved := make(map[string]string)
+	result, err := csvpkg.NewProcessor(csvpkg.WithWorkers(1)).ProcessRows(context.Background(), csvFile, "image_url", func(ctx context.Context, row csvpkg.Row) error {
+		if !utils.IsValidURL(row.URL) {
+			return downloader.InvalidURLError(row.URL)
+		}
+		req := downloader.Request{URL: row.URL, Dir: downloadDir, RowNum: row.Num}
+		key := utils.NormalizeURL(row.URL)
+		mu.Lock()
+		src, ok := saved[key]
+		mu.Unlock()
+		if ok {
+			_, err := downloader.Link(req, src, downloader.LinkCopy)
+			return err
+		}
+		res, err := d.Download(ctx, req)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		saved[key] = res.Path
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	if result.SuccessCount != 3 || result.ErrorCount != 0 {
+		t.Errorf("Expected all rows to succeed, got %+v", result)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected a single request for the repeated URL, got %d", n)
+	}
+	th.AssertFilesExist(downloadDir, []string{"image_1.png", "image_2.png", "image_3.png"})
+}
@@ -1,18 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	csvpkg "github.com/sbleks/go-get-imgs/internal/csv"
 	"github.com/sbleks/go-get-imgs/internal/downloader"
+	"github.com/sbleks/go-get-imgs/internal/naming"
+	"github.com/sbleks/go-get-imgs/internal/report"
 	"github.com/sbleks/go-get-imgs/internal/utils"
 )
 
@@ -341,6 +365,11 @@ func TestIsValidURL(t *testing.T) {
 		{"  invalid-url  ", false},
 		{"https://", false}, // Incomplete URL
 		{"http://", false},  // Incomplete URL
+		{"data:image/png;base64,iVBORw0KGgo=", true},
+		{"data:image/png;base64", false},       // No data
+		{"HTTP://Example.com/image.png", true}, // Schemes are case-insensitive
+		{"File:///path/to/image.jpg", true},
+		{"HTTPS://", false},
 	}
 
 	for _, tc := range testCases {
@@ -352,3 +381,1572 @@ func TestIsValidURL(t *testing.T) {
 		})
 	}
 }
+
+// TestDownloadImageRetries tests retrying of transient failures
+func TestDownloadImageRetries(t *testing.T) {
+	policy := downloader.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	d := downloader.NewDownloader(30*time.Second, downloader.WithRetryPolicy(policy))
+
+	// 503 and 429 are retried, honoring Retry-After
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			if _, err := w.Write([]byte("fake image data")); err != nil {
+				t.Errorf("Failed to write response: %v", err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	if err := d.DownloadImage(server.URL, "test_downloads", 200); err != nil {
+		t.Errorf("Expected download to succeed after retries, got error: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+
+	// 404 is never retried
+	notFoundRequests := 0
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notFoundRequests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notFound.Close()
+
+	err := d.DownloadImage(notFound.URL, "test_downloads", 201)
+	if notFoundRequests != 1 {
+		t.Errorf("Expected 404 not to be retried, got %d requests", notFoundRequests)
+	}
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.StatusCode != http.StatusNotFound || dErr.Attempts != 1 {
+		t.Errorf("Expected DownloadError with status 404 after 1 attempt, got %v", err)
+	}
+
+	// Persistent 500s exhaust the attempts and report the count
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	err = d.DownloadImage(failing.URL, "test_downloads", 202)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("Expected error reporting 3 attempts, got %v", err)
+	}
+}
+
+// TestResolveColumn tests selecting the URL column by header name or index
+func TestResolveColumn(t *testing.T) {
+	header := []string{"\ufeffid", "name", " Image_URL ", "description"}
+
+	testCases := []struct {
+		column      string
+		expected    int
+		expectedErr string
+	}{
+		{"image_url", 3, ""},
+		{"IMAGE_URL", 3, ""},
+		{"id", 1, ""},
+		{"3", 3, ""},
+		{"5", 0, "expected at least 5 columns"},
+		{"0", 0, "at least 1"},
+		{"photo", 0, "available columns: id, name, Image_URL, description"},
+		{"", 0, "must not be empty"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Column_%s", tc.column), func(t *testing.T) {
+			index, err := csvpkg.ResolveColumn(header, tc.column)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Errorf("Expected error containing %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if index != tc.expected {
+				t.Errorf("Expected index %d, got %d", tc.expected, index)
+			}
+		})
+	}
+}
+
+// TestResolveColumnNumericHeaders tests that header names that look like
+// numbers win over indexes, and that #N always selects the Nth column
+func TestResolveColumnNumericHeaders(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	header := []string{"id", "2019", "2", "url"}
+	for column, expected := range map[string]int{"2": 3, "#2": 2, "2019": 2, "#4": 4, csvpkg.IndexColumn(1): 1} {
+		if index, err := csvpkg.ResolveColumn(header, column); err != nil || index != expected {
+			t.Errorf("Expected column %q to resolve to %d, got %d, %v", column, expected, index, err)
+		}
+	}
+	for _, column := range []string{"#5", "#0", "#url", "#"} {
+		if _, err := csvpkg.ResolveColumn(header, column); err == nil {
+			t.Errorf("Expected column %q to be rejected", column)
+		}
+	}
+
+	// The positional <url-column-index> argument is passed as IndexColumn
+	csvFile := th.CreateTestCSV("numeric_header_test.csv", `id,2019,2,url
+1,https://example.com/a.jpg,y,https://example.com/b.jpg`)
+	var urls []string
+	if _, err := csvpkg.NewProcessor().ProcessCSVColumn(csvFile, csvpkg.IndexColumn(2), func(url string, rowNum int) error {
+		urls = append(urls, url)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+	if len(urls) != 1 || urls[0] != "https://example.com/a.jpg" {
+		t.Errorf("Expected the URL from the 2nd column, got %v", urls)
+	}
+}
+
+// TestProcessCSVColumnByName tests that URLs are taken from the named column regardless of its position
+func TestProcessCSVColumnByName(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	csvFile := th.CreateTestCSV("column_by_name_test.csv", `image_url,id,name
+https://example.com/a.jpg,1,First
+https://example.com/b.jpg,2,Second`)
+
+	var urls []string
+	result, err := csvpkg.NewProcessor().ProcessCSVColumn(csvFile, "Image_Url", func(url string, rowNum int) error {
+		urls = append(urls, url)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to process CSV file: %v", err)
+	}
+
+	if result.SuccessCount != 2 || len(urls) != 2 || urls[0] != "https://example.com/a.jpg" {
+		t.Errorf("Expected URLs from the image_url column, got %v", urls)
+	}
+
+	if _, err := csvpkg.NewProcessor().ProcessCSVColumn(csvFile, "photo", func(url string, rowNum int) error {
+		return nil
+	}); err == nil || !strings.Contains(err.Error(), "image_url, id, name") {
+		t.Errorf("Expected error listing available headers, got %v", err)
+	}
+}
+
+// TestNameTemplate tests rendering of output file name templates
+func TestNameTemplate(t *testing.T) {
+	header := []string{"sku", "angle", "image_url"}
+	record := []string{"AB/12", "front", "https://cdn.example.com/p/shoe-1.png?w=800"}
+
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{naming.DefaultTemplate, "image_7.png"},
+		{"{col:sku}_{col:angle}{ext}", "AB_12_front.png"},
+		{"{col:2}-{row:05d}{ext}", "front-00007.png"},
+		{"{row:05d}-{urlbase}{ext}", "00007-shoe-1.png"},
+		{"{urlhash:8}{ext}", ""}, // checked separately below
+		{"{col:angle}/{col:sku}{ext}", filepath.Join("front", "AB_12.png")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.template, func(t *testing.T) {
+			tmpl, err := naming.Parse(tc.template)
+			if err != nil {
+				t.Fatalf("Failed to parse template: %v", err)
+			}
+			if err := tmpl.Validate(header); err != nil {
+				t.Fatalf("Failed to validate template: %v", err)
+			}
+
+			name, err := tmpl.Render(naming.Data{Row: 7, URL: record[2], Ext: ".png", Header: header, Record: record})
+			if err != nil {
+				t.Fatalf("Failed to render template: %v", err)
+			}
+
+			if tc.expected == "" {
+				if len(name) != len("12345678.png") || !strings.HasSuffix(name, ".png") {
+					t.Errorf("Expected an 8 character hash name, got %q", name)
+				}
+				return
+			}
+			if name != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, name)
+			}
+		})
+	}
+
+	// Invalid templates are rejected
+	for _, invalid := range []string{"{nope}{ext}", "{row:x}", "{col:}", "image_{row", "image}{ext}", "{urlhash:99}"} {
+		if _, err := naming.Parse(invalid); err == nil {
+			t.Errorf("Expected template %q to be rejected", invalid)
+		}
+	}
+
+	// Unknown columns are reported before any download
+	tmpl, err := naming.Parse("{col:color}{ext}")
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	if err := tmpl.Validate(header); err == nil {
+		t.Error("Expected unknown column to fail validation")
+	}
+
+	// Templates cannot escape the output directory or produce empty names
+	for _, tc := range []struct {
+		template string
+		record   []string
+	}{
+		{"../{row}{ext}", record},
+		{"{col:sku}{ext}", []string{"", "front", record[2]}},
+	} {
+		tmpl, err := naming.Parse(tc.template)
+		if err != nil {
+			t.Fatalf("Failed to parse template: %v", err)
+		}
+		if _, err := tmpl.Render(naming.Data{Row: 1, URL: record[2], Ext: ".png", Header: header, Record: tc.record}); err == nil {
+			t.Errorf("Expected template %q to fail for %v", tc.template, tc.record)
+		}
+	}
+}
+
+// TestSanitizeFilename tests removal of characters that are illegal in file names
+func TestSanitizeFilename(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"plain-name", "plain-name"},
+		{`a<b>c:d"e/f\g|h?i*j`, "a_b_c_d_e_f_g_h_i_j"},
+		{"tab\there", "tab_here"},
+		{"trailing. ", "trailing"},
+		{"..", "_"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"", ""},
+	}
+
+	for _, tc := range testCases {
+		if result := naming.Sanitize(tc.value); result != tc.expected {
+			t.Errorf("Sanitize(%q): expected %q, got %q", tc.value, tc.expected, result)
+		}
+	}
+}
+
+// TestDetectImageType tests identification of image formats from their leading bytes
+func TestDetectImageType(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"JPEG", "\xFF\xD8\xFF\xE0\x00\x10JFIF", ".jpg"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", ".png"},
+		{"GIF87a", "GIF87a\x01\x00", ".gif"},
+		{"GIF89a", "GIF89a\x01\x00", ".gif"},
+		{"WebP", "RIFF\x24\x00\x00\x00WEBPVP8 ", ".webp"},
+		{"BMP", "BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00", ".bmp"},
+		{"TIFF little endian", "II*\x00\x08\x00\x00\x00", ".tiff"},
+		{"TIFF big endian", "MM\x00*\x00\x00\x00\x08", ".tiff"},
+		{"AVIF", "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf", ".avif"},
+		{"AVIF compatible brand", "\x00\x00\x00\x1cftypmif1\x00\x00\x00\x00mif1avifmiaf", ".avif"},
+		{"HEIC", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", ".heic"},
+		{"SVG", "<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>", ".svg"},
+		{"SVG with XML declaration", "\xEF\xBB\xBF<?xml version=\"1.0\"?>\n<!-- logo -->\n<svg></svg>", ".svg"},
+		{"ICO", "\x00\x00\x01\x00\x01\x00\x10\x10", ".ico"},
+		{"HTML error page", "<!DOCTYPE html><html><body><svg></svg>Not found</body></html>", ""},
+		{"MP4 video", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom", ""},
+		{"Plain text", "fake image data", ""},
+		{"Empty", "", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := downloader.DetectImageType([]byte(tc.data)); result != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestDownloadImageContentSniffing tests that image bytes take precedence over the Content-Type header
+func TestDownloadImageContentSniffing(t *testing.T) {
+	pngData := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	htmlData := "<!DOCTYPE html><html><body>Image not found</body></html>"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/octet.jpg":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, pngData)
+		case "/lying":
+			w.Header().Set("Content-Type", "image/jpeg")
+			fmt.Fprint(w, pngData)
+		default:
+			w.Header().Set("Content-Type", "image/jpeg")
+			fmt.Fprint(w, htmlData)
+		}
+	}))
+	defer server.Close()
+
+	d := downloader.NewDownloader(30 * time.Second)
+	for i, path := range []string{"/octet.jpg", "/lying"} {
+		res, err := d.Download(context.Background(), downloader.Request{URL: server.URL + path, Dir: "test_downloads", RowNum: 300 + i})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		if filepath.Ext(res.Path) != ".png" {
+			t.Errorf("%s: expected sniffed .png extension, got %s", path, res.Path)
+		}
+	}
+
+	// HTML served as an image is kept by default but rejected when requested
+	if err := d.DownloadImage(server.URL+"/error", "test_downloads", 302); err != nil {
+		t.Errorf("Expected HTML body to be accepted without rejection, got %v", err)
+	}
+
+	strict := downloader.NewDownloader(30*time.Second, downloader.WithRejectNonImage(true))
+	err := strict.DownloadImage(server.URL+"/error", "test_downloads", 303)
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryNotImage {
+		t.Errorf("Expected not-image error, got %v", err)
+	}
+	if _, statErr := os.Stat(filepath.Join("test_downloads", "image_303.jpg")); !os.IsNotExist(statErr) {
+		t.Error("Expected no file for rejected non-image response")
+	}
+}
+
+// TestDownloadImageTruncatedBody tests that a dropped connection leaves no partial file behind
+func TestDownloadImageTruncatedBody(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("Response writer does not support hijacking")
+		}
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("Failed to hijack connection: %v", err)
+		}
+		defer conn.Close()
+
+		// Promise 1000 bytes but drop the connection after 10
+		fmt.Fprint(buf, "HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\nContent-Length: 1000\r\n\r\n\xFF\xD8\xFF0123456")
+		buf.Flush()
+	}))
+
+	downloadDir := th.CreateTestDirectory("truncated_downloads")
+	d := downloader.NewDownloader(30*time.Second, downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+
+	err := d.DownloadImage(server.URL, downloadDir, 1)
+	if err == nil {
+		t.Fatal("Expected error for truncated body, got nil")
+	}
+	if !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("Expected truncated body to be retried, got %v", err)
+	}
+
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to read download directory: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Expected no files after failed download, found %s", entry.Name())
+	}
+}
+
+// TestDownloadSkipExisting tests that rows whose file already exists are
+// skipped without a request
+func TestDownloadSkipExisting(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var requests atomic.Int32
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nnew")
+	}))
+
+	downloadDir := th.CreateTestDirectory("skip_existing_downloads")
+	existing := filepath.Join(downloadDir, "image_1.png")
+	if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to create existing file: %v", err)
+	}
+
+	d := downloader.NewDownloader(30*time.Second, downloader.WithSkipExisting(true))
+
+	res, err := d.Download(context.Background(), downloader.Request{URL: server.URL + "/a.jpg", Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !res.Skipped || res.Path != existing {
+		t.Errorf("Expected existing file %s to be skipped, got %+v", existing, res)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "old" {
+		t.Errorf("Expected existing file to be left untouched, got %q", data)
+	}
+
+	res, err = d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 2})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if res.Skipped || requests.Load() != 1 {
+		t.Errorf("Expected missing file to be downloaded with one request, got %+v after %d requests", res, requests.Load())
+	}
+
+	// Existing lets callers that link instead of downloading, such as
+	// --dedupe, skip the same rows Download would
+	if res, ok := d.Existing(downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1}); !ok || !res.Skipped || res.Path != existing {
+		t.Errorf("Expected existing file %s to be reported, got %+v, %v", existing, res, ok)
+	}
+	if res, ok := d.Existing(downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 3}); ok {
+		t.Errorf("Expected no existing file for row 3, got %+v", res)
+	}
+	plain := downloader.NewDownloader(30 * time.Second)
+	if res, ok := plain.Existing(downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1}); ok {
+		t.Errorf("Expected nothing to be skipped without WithSkipExisting, got %+v", res)
+	}
+}
+
+// TestDownloadConditionalRequest tests that cached validators are sent as
+// conditional request headers and that a 304 keeps the saved file
+func TestDownloadConditionalRequest(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	const etag = `"v1"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nsynced")
+	}))
+
+	downloadDir := th.CreateTestDirectory("conditional_downloads")
+	d := downloader.NewDownloader(30 * time.Second)
+
+	first, err := d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if first.ETag != etag || first.LastModified != lastModified || first.NotModified {
+		t.Fatalf("Unexpected first result: %+v", first)
+	}
+
+	cached := &downloader.Cached{Path: first.Path, ETag: first.ETag, LastModified: first.LastModified}
+	second, err := d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1, Cached: cached})
+	if err != nil {
+		t.Fatalf("Conditional download failed: %v", err)
+	}
+	if !second.NotModified || second.StatusCode != http.StatusNotModified || second.Path != first.Path || second.ETag != etag {
+		t.Errorf("Expected 304 to keep the cached file, got %+v", second)
+	}
+
+	// A cached file that has gone missing is fetched again unconditionally
+	if err := os.Remove(first.Path); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	third, err := d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1, Cached: cached})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if third.NotModified || third.StatusCode != http.StatusOK {
+		t.Errorf("Expected full download when cached file is missing, got %+v", third)
+	}
+	th.AssertFilesExist(downloadDir, []string{"image_1.png"})
+}
+
+// TestDownloadImageResumeWithRange tests that an interrupted download is resumed
+// with a Range request, and started over when the server ignores the range
+func TestDownloadImageResumeWithRange(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("0123456789", 200))
+	const etag = `"img-v1"`
+
+	var requests atomic.Int32
+	var ranges []string
+	mode := ""
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("Response writer does not support hijacking")
+			}
+			conn, buf, err := hj.Hijack()
+			if err != nil {
+				t.Fatalf("Failed to hijack connection: %v", err)
+			}
+			defer conn.Close()
+
+			// Drop the connection after the first 1000 bytes
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nAccept-Ranges: bytes\r\nETag: %s\r\nContent-Length: %d\r\n\r\n", etag, len(image))
+			buf.Write(image[:1000])
+			buf.Flush()
+			return
+		}
+
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		if mode == "unavailable" && len(ranges) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if mode == "ignore" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "image.png", time.Time{}, bytes.NewReader(image))
+	}))
+
+	downloadDir := th.CreateTestDirectory("resume_downloads")
+	d := downloader.NewDownloader(30*time.Second, downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+
+	// A transient error on the resume attempt keeps the data received so far
+	for _, m := range []string{"resume", "ignore", "unavailable"} {
+		requests.Store(0)
+		ranges = nil
+		mode = m
+		attempts := 2
+		if m == "unavailable" {
+			attempts = 3
+		}
+
+		res, err := d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1})
+		if err != nil {
+			t.Fatalf("Download failed (%s): %v", m, err)
+		}
+		want := "bytes=1000- " + etag
+		if len(ranges) != attempts-1 || ranges[0] != want || ranges[len(ranges)-1] != want {
+			t.Errorf("Expected %d resume requests %q (%s), got %q", attempts-1, want, m, ranges)
+		}
+		if res.Attempts != attempts || res.Bytes != int64(len(image)) {
+			t.Errorf("Expected %d bytes after %d attempts (%s), got %+v", len(image), attempts, m, res)
+		}
+		data, err := os.ReadFile(res.Path)
+		if err != nil {
+			t.Fatalf("Failed to read downloaded file: %v", err)
+		}
+		if !bytes.Equal(data, image) {
+			t.Errorf("Downloaded file does not match the image (%s): got %d bytes", m, len(data))
+		}
+	}
+
+	th.AssertFilesExist(downloadDir, []string{"image_1.png"})
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to read download directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the finished image, found %d entries", len(entries))
+	}
+}
+
+// TestDownloadLimits tests per-host connection limits and request rate limiting
+func TestDownloadLimits(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var inFlight, maxInFlight atomic.Int32
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nlimited")
+	}))
+
+	downloadDir := th.CreateTestDirectory("limited_downloads")
+	download := func(d *downloader.Downloader, url string, rows int) {
+		var wg sync.WaitGroup
+		for row := 1; row <= rows; row++ {
+			wg.Add(1)
+			go func(row int) {
+				defer wg.Done()
+				if err := d.DownloadImage(url, downloadDir, row); err != nil {
+					t.Errorf("Download of row %d failed: %v", row, err)
+				}
+			}(row)
+		}
+		wg.Wait()
+	}
+
+	// The same server is reached as two hosts: 127.0.0.1 and localhost
+	localURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	d := downloader.NewDownloader(30*time.Second, downloader.WithLimits(downloader.Limits{
+		Host:  downloader.HostLimits{MaxConns: 1},
+		Hosts: map[string]downloader.HostLimits{"LOCALHOST": {MaxConns: 4}},
+	}))
+
+	download(d, server.URL, 4)
+	if got := maxInFlight.Load(); got != 1 {
+		t.Errorf("Expected at most 1 request in flight to 127.0.0.1, got %d", got)
+	}
+
+	maxInFlight.Store(0)
+	download(d, localURL, 4)
+	if got := maxInFlight.Load(); got < 2 {
+		t.Errorf("Expected the localhost override to allow concurrent requests, got %d in flight", got)
+	}
+
+	rateLimited := downloader.NewDownloader(30*time.Second, downloader.WithLimits(downloader.Limits{RPS: 20}))
+	start := time.Now()
+	download(rateLimited, server.URL, 4)
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("Expected 4 requests at 20 rps to take at least 150ms, took %v", elapsed)
+	}
+}
+
+// TestDownloadBandwidthLimit tests that response bodies are read no faster than the bandwidth limit
+func TestDownloadBandwidthLimit(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 50000)...)
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+
+	downloadDir := th.CreateTestDirectory("throttled_downloads")
+	d := downloader.NewDownloader(30*time.Second, downloader.WithLimits(downloader.Limits{Bandwidth: 100000}))
+
+	// The first tenth of a second's worth is allowed as a burst
+	res, err := d.Download(context.Background(), downloader.Request{URL: server.URL, Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if res.Bytes != int64(len(image)) {
+		t.Errorf("Expected %d bytes, got %d", len(image), res.Bytes)
+	}
+	if res.Duration < 350*time.Millisecond {
+		t.Errorf("Expected 50KB at 100KB/s to take at least 350ms, took %v", res.Duration)
+	}
+}
+
+// TestParseByteSize tests parsing sizes and rates with decimal and binary units
+func TestParseByteSize(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"512", 512, false},
+		{"200KB", 200000, false},
+		{"5MB/s", 5000000, false},
+		{"1.5MiB", 1572864, false},
+		{"2 gib", 2 << 30, false},
+		{"", 0, true},
+		{"-1MB", 0, true},
+		{"5 parsecs", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := utils.ParseByteSize(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %d", tc.input, got)
+				}
+				return
+			}
+			if err != nil || got != tc.expected {
+				t.Errorf("ParseByteSize(%q) = %d, %v; expected %d", tc.input, got, err, tc.expected)
+			}
+		})
+	}
+}
+
+// TestDownloadRequestHeaders tests the User-Agent, extra headers, credentials,
+// cookies and per-host header rules sent with each request
+func TestDownloadRequestHeaders(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var got http.Header
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nprivate")
+	}))
+
+	downloadDir := th.CreateTestDirectory("header_downloads")
+	cookieFile := filepath.Join(downloadDir, "cookies.txt")
+	cookies := "# Netscape HTTP Cookie File\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tabc123\n" +
+		"#HttpOnly_127.0.0.1\tFALSE\t/\tFALSE\t0\tsecret\txyz\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t1\texpired\told\n" +
+		"other.example.com\tFALSE\t/\tFALSE\t0\tforeign\tnope\n"
+	if err := os.WriteFile(cookieFile, []byte(cookies), 0644); err != nil {
+		t.Fatalf("Failed to write cookie file: %v", err)
+	}
+	jar, err := downloader.LoadCookieFile(cookieFile)
+	if err != nil {
+		t.Fatalf("Failed to load cookie file: %v", err)
+	}
+
+	rulesFile := filepath.Join(downloadDir, "rules.json")
+	rules := `{"127.0.0.1": {"X-Api-Key": "exact", "Referer": "https://shop.example.com/"}, "*.example.com": {"X-Api-Key": "wildcard"}}`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatalf("Failed to write header rules: %v", err)
+	}
+	hostRules, err := downloader.LoadHeaderRules(rulesFile)
+	if err != nil {
+		t.Fatalf("Failed to load header rules: %v", err)
+	}
+
+	d := downloader.NewDownloader(30*time.Second,
+		downloader.WithUserAgent("go-get-imgs/test"),
+		downloader.WithHeaders(http.Header{"X-Api-Key": {"global"}, "Accept": {"image/*"}}),
+		downloader.WithBearerToken("s3cret"),
+		downloader.WithCookieJar(jar),
+		downloader.WithHostHeaders(hostRules),
+	)
+	if err := d.DownloadImage(server.URL, downloadDir, 1); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"User-Agent":    "go-get-imgs/test",
+		"Accept":        "image/*",
+		"Authorization": "Bearer s3cret",
+		"X-Api-Key":     "exact",
+		"Referer":       "https://shop.example.com/",
+		"Cookie":        "session=abc123; secret=xyz",
+	}
+	for name, want := range expected {
+		if value := got.Get(name); value != want {
+			t.Errorf("Expected %s %q, got %q", name, want, value)
+		}
+	}
+
+	basic := downloader.NewDownloader(30*time.Second, downloader.WithBasicAuth("user", "pa:ss"))
+	if err := basic.DownloadImage(server.URL, downloadDir, 2); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if auth := got.Get("Authorization"); auth != "Basic dXNlcjpwYTpzcw==" {
+		t.Errorf("Expected Basic credentials, got %q", auth)
+	}
+
+	// The same server reached as 127.0.0.1 and as localhost, with credentials
+	// restricted to the first
+	scoped := downloader.NewDownloader(30*time.Second,
+		downloader.WithBearerToken("s3cret"),
+		downloader.WithAuthHosts([]string{"127.0.0.1"}),
+	)
+	if err := scoped.DownloadImage(server.URL, downloadDir, 3); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if auth := got.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("Expected credentials for an allowed host, got %q", auth)
+	}
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := scoped.DownloadImage(other, downloadDir, 4); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if auth := got.Get("Authorization"); auth != "" {
+		t.Errorf("Expected no credentials for another host, got %q", auth)
+	}
+}
+
+// TestDownloadHeaderRulesNestedWildcard tests that a wildcard rule for a
+// subdomain overrides one for its parent domain, and an exact rule both
+func TestDownloadHeaderRulesNestedWildcard(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	// The server acts as a proxy for every host, so no name needs to resolve
+	got := make(map[string]string)
+	var mu sync.Mutex
+	proxy := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.URL.Hostname()] = r.Header.Get("X-Api-Key")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nrules")
+	}))
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	downloadDir := th.CreateTestDirectory("header_rule_downloads")
+	rulesFile := filepath.Join(downloadDir, "rules.json")
+	rules := `{"*.example.com": {"X-Api-Key": "domain"}, "*.cdn.example.com": {"X-Api-Key": "cdn"}, "exact.cdn.example.com": {"X-Api-Key": "exact"}}`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatalf("Failed to write header rules: %v", err)
+	}
+	hostRules, err := downloader.LoadHeaderRules(rulesFile)
+	if err != nil {
+		t.Fatalf("Failed to load header rules: %v", err)
+	}
+
+	d := downloader.NewDownloader(30*time.Second, downloader.WithTransport(transport), downloader.WithHostHeaders(hostRules))
+	expected := map[string]string{
+		"www.example.com":       "domain",
+		"img.cdn.example.com":   "cdn",
+		"exact.cdn.example.com": "exact",
+	}
+	row := 0
+	for host := range expected {
+		row++
+		if err := d.DownloadImage("http://"+host+"/image.png", downloadDir, row); err != nil {
+			t.Fatalf("Download from %s failed: %v", host, err)
+		}
+	}
+	for host, want := range expected {
+		if got[host] != want {
+			t.Errorf("Expected X-Api-Key %q for %s, got %q", want, host, got[host])
+		}
+	}
+}
+
+// TestDownloadTLSAndProxy tests private CA bundles, mutual TLS, skipping
+// verification and sending requests through a proxy
+func TestDownloadTLSAndProxy(t *testing.T) {
+	downloadDir, err := os.MkdirTemp("", "tls_downloads")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(downloadDir)
+
+	// Self-signed client certificate the server requires
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-get-imgs test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, template, template, &clientKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+	clientCert, _ := x509.ParseCertificate(clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(downloadDir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	clientCertFile := writePEM("client.pem", "CERTIFICATE", clientDER)
+	clientKeyFile := writePEM("client-key.pem", "EC PRIVATE KEY", keyDER)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nsecure")
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := writePEM("ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	download := func(opts downloader.TransportOptions, rowNum int) error {
+		transport, err := downloader.NewTransport(opts)
+		if err != nil {
+			t.Fatalf("Failed to build transport: %v", err)
+		}
+		d := downloader.NewDownloader(5*time.Second, downloader.WithTransport(transport), downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 1}))
+		return d.DownloadImage(server.URL, downloadDir, rowNum)
+	}
+
+	if err := download(downloader.TransportOptions{ClientCertFile: clientCertFile, ClientKeyFile: clientKeyFile}, 1); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected certificate error for untrusted server, got %v", err)
+	}
+	if err := download(downloader.TransportOptions{CACertFile: caFile}, 2); err == nil {
+		t.Error("Expected error without a client certificate")
+	}
+	if err := download(downloader.TransportOptions{CACertFile: caFile, ClientCertFile: clientCertFile, ClientKeyFile: clientKeyFile}, 3); err != nil {
+		t.Errorf("Expected download with CA bundle and client certificate to succeed, got %v", err)
+	}
+	if err := download(downloader.TransportOptions{InsecureSkipVerify: true, ClientCertFile: clientCertFile, ClientKeyFile: clientKeyFile}, 4); err != nil {
+		t.Errorf("Expected download with verification disabled to succeed, got %v", err)
+	}
+	if _, err := downloader.NewTransport(downloader.TransportOptions{ClientCertFile: clientCertFile}); err == nil {
+		t.Error("Expected error for client certificate without key")
+	}
+
+	// A plain HTTP proxy receives the absolute URL and the proxy credentials
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String()+" "+r.Header.Get("Proxy-Authorization"))
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "\x89PNG\r\n\x1a\nproxied")
+	}))
+	defer proxy.Close()
+
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://user:pass@", 1)
+	transport, err := downloader.NewTransport(downloader.TransportOptions{Proxy: proxyURL})
+	if err != nil {
+		t.Fatalf("Failed to build transport: %v", err)
+	}
+	d := downloader.NewDownloader(5*time.Second, downloader.WithTransport(transport))
+	if err := d.DownloadImage("http://images.example.com/a.png", downloadDir, 5); err != nil {
+		t.Fatalf("Download through proxy failed: %v", err)
+	}
+	if want := "http://images.example.com/a.png Basic dXNlcjpwYXNz"; len(proxied) != 1 || proxied[0] != want {
+		t.Errorf("Expected proxied request %q, got %q", want, proxied)
+	}
+}
+
+// TestDownloadFileAndFTPURLs tests that file:// and ftp:// URLs are fetched
+// natively and named like HTTP downloads
+func TestDownloadFileAndFTPURLs(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	png := []byte("\x89PNG\r\n\x1a\nnative")
+	root := th.CreateTestDirectory("file_root")
+	if err := os.WriteFile(filepath.Join(root, "local.png"), png, 0644); err != nil {
+		t.Fatalf("Failed to write source image: %v", err)
+	}
+	outside := th.CreateTestDirectory("file_outside")
+	if err := os.WriteFile(filepath.Join(outside, "secret.png"), png, 0644); err != nil {
+		t.Fatalf("Failed to write source image: %v", err)
+	}
+	absRoot, _ := filepath.Abs(root)
+	absOutside, _ := filepath.Abs(outside)
+	fileURL := func(path string) string {
+		return "file://" + filepath.ToSlash(path)
+	}
+
+	downloadDir := th.CreateTestDirectory("native_downloads")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithFileRoot(root), downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 1}))
+
+	res, err := d.Download(context.Background(), downloader.Request{URL: fileURL(filepath.Join(absRoot, "local.png")), Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("file:// download failed: %v", err)
+	}
+	if res.Path != filepath.Join(downloadDir, "image_1.png") || res.Bytes != int64(len(png)) {
+		t.Errorf("Unexpected file:// result: %+v", res)
+	}
+
+	for _, url := range []string{
+		fileURL(filepath.Join(absOutside, "secret.png")),
+		fileURL(filepath.Join(absRoot, "..", "file_outside", "secret.png")),
+	} {
+		_, err := d.Download(context.Background(), downloader.Request{URL: url, Dir: downloadDir, RowNum: 2})
+		var dErr *downloader.DownloadError
+		if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryOutsideRoot {
+			t.Errorf("Expected outside-root error for %s, got %v", url, err)
+		}
+	}
+
+	noRoot := downloader.NewDownloader(5 * time.Second)
+	if err := noRoot.DownloadImage(fileURL(filepath.Join(absRoot, "local.png")), downloadDir, 3); err == nil {
+		t.Error("Expected file:// URL to be rejected without a file root")
+	}
+
+	addr := th.CreateTestFTPServer("scanner", "pa55", map[string][]byte{"scans/remote.png": png, "aborted/remote.png": png})
+	res, err = d.Download(context.Background(), downloader.Request{URL: "ftp://scanner:pa55@" + addr + "/scans/remote.png", Dir: downloadDir, RowNum: 4})
+	if err != nil {
+		t.Fatalf("ftp:// download failed: %v", err)
+	}
+	if res.Path != filepath.Join(downloadDir, "image_4.png") || res.Bytes != int64(len(png)) {
+		t.Errorf("Unexpected ftp:// result: %+v", res)
+	}
+
+	_, err = d.Download(context.Background(), downloader.Request{URL: "ftp://scanner:wrong@" + addr + "/scans/remote.png", Dir: downloadDir, RowNum: 5})
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryFTPStatus || !strings.Contains(err.Error(), "530") {
+		t.Errorf("Expected ftp-status error for bad credentials, got %v", err)
+	}
+
+	_, err = d.Download(context.Background(), downloader.Request{URL: "ftp://scanner:pa55@" + addr + "/scans/missing.png", Dir: downloadDir, RowNum: 6})
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryFTPStatus || dErr.Attempts != 1 {
+		t.Errorf("Expected final ftp-status error for missing file, got %v", err)
+	}
+
+	// The reply closing the transfer decides, even once all the data arrived
+	_, err = d.Download(context.Background(), downloader.Request{URL: "ftp://scanner:pa55@" + addr + "/aborted/remote.png", Dir: downloadDir, RowNum: 7})
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryFTPStatus || !strings.Contains(err.Error(), "451") {
+		t.Errorf("Expected ftp-status error for an aborted transfer, got %v", err)
+	}
+
+	th.AssertFilesExist(downloadDir, []string{"image_1.png", "image_4.png"})
+}
+
+// TestDownloadDataURI tests that data: URIs are decoded and saved like downloads
+func TestDownloadDataURI(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	png := []byte("\x89PNG\r\n\x1a\ninline thumbnail")
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	downloadDir := th.CreateTestDirectory("data_uri_downloads")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithMaxDataURISize(64))
+
+	testCases := []struct {
+		uri      string
+		expected []byte
+		file     string
+	}{
+		{"data:image/png;base64," + base64.StdEncoding.EncodeToString(png), png, "image_1.png"},
+		{"data:image/svg+xml," + url.PathEscape(svg), []byte(svg), "image_2.svg"},
+		{"data:image/gif;base64,R0lG%0AODlh", []byte("GIF89a"), "image_3.gif"},
+	}
+	for i, tc := range testCases {
+		res, err := d.Download(context.Background(), downloader.Request{URL: tc.uri, Dir: downloadDir, RowNum: i + 1})
+		if err != nil {
+			t.Errorf("Download of %s failed: %v", tc.uri, err)
+			continue
+		}
+		if res.Path != filepath.Join(downloadDir, tc.file) {
+			t.Errorf("Expected %s, got %s", tc.file, res.Path)
+		}
+		if data, _ := os.ReadFile(res.Path); !bytes.Equal(data, tc.expected) {
+			t.Errorf("Expected %q in %s, got %q", tc.expected, tc.file, data)
+		}
+	}
+
+	large := "data:image/png;base64," + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0}, 100))
+	_, err := d.Download(context.Background(), downloader.Request{URL: large, Dir: downloadDir, RowNum: 4})
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryTooLarge {
+		t.Errorf("Expected too-large error, got %v", err)
+	}
+
+	_, err = d.Download(context.Background(), downloader.Request{URL: "data:image/png;base64,!!!", Dir: downloadDir, RowNum: 5})
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryInvalidURL {
+		t.Errorf("Expected invalid-url error for bad base64, got %v", err)
+	}
+}
+
+// TestRecordedURL tests that long data: URIs are kept in state files, reports
+// and error files shortened but still tell different images apart
+func TestRecordedURL(t *testing.T) {
+	for _, url := range []string{"https://example.com/a.png", "data:image/png;base64,iVBORw0KGgo="} {
+		if got := utils.RecordedURL(url); got != url {
+			t.Errorf("Expected %q to be recorded unchanged, got %q", url, got)
+		}
+	}
+
+	prefix := "data:image/png;base64," + strings.Repeat("A", 100)
+	first := prefix + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 1<<20))
+	second := prefix + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 1<<20))
+	recorded := utils.RecordedURL(first)
+	if len(recorded) > 200 || !strings.HasPrefix(recorded, "data:image/png;base64,") {
+		t.Errorf("Expected a short data: URI, got %q", recorded)
+	}
+	if recorded != utils.RecordedURL(first) || recorded == utils.RecordedURL(second) {
+		t.Errorf("Expected recorded forms to match only for the same URI")
+	}
+
+	if rowErr := csvpkg.NewRowError(1, first, errors.New("failed")); rowErr.URL != recorded {
+		t.Errorf("Expected the row error to keep the recorded form, got %d bytes", len(rowErr.URL))
+	}
+}
+
+// TestDownloadSizeLimits tests that oversized bodies are rejected up front or
+// mid-stream and that tiny placeholder images are flagged
+func TestDownloadSizeLimits(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 5000)...)
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/declared":
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+			w.Write(image)
+		case "/streamed":
+			// Flushing first forces chunked encoding without a Content-Length
+			w.(http.Flusher).Flush()
+			w.Write(image)
+		case "/tiny":
+			w.Write(image[:20])
+		default:
+			w.Write(image[:2000])
+		}
+	}))
+
+	downloadDir := th.CreateTestDirectory("size_limited_downloads")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithMaxSize(4096), downloader.WithMinSize(100))
+
+	testCases := []struct {
+		path     string
+		category string
+	}{
+		{"/declared", downloader.CategoryTooLarge},
+		{"/streamed", downloader.CategoryTooLarge},
+		{"/tiny", downloader.CategoryTooSmall},
+		{"/ok", ""},
+	}
+	for i, tc := range testCases {
+		_, err := d.Download(context.Background(), downloader.Request{URL: server.URL + tc.path, Dir: downloadDir, RowNum: i + 1})
+		if tc.category == "" {
+			if err != nil {
+				t.Errorf("Expected %s to succeed, got %v", tc.path, err)
+			}
+			continue
+		}
+		var dErr *downloader.DownloadError
+		if !errors.As(err, &dErr) || dErr.Category != tc.category || dErr.Attempts != 1 {
+			t.Errorf("Expected final %s error for %s, got %v", tc.category, tc.path, err)
+		}
+	}
+
+	entries, err := os.ReadDir(downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to read download directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "image_4.png" {
+		t.Errorf("Expected only image_4.png to be saved, found %d entries", len(entries))
+	}
+}
+
+// TestDownloadSafeMode tests that safe mode refuses internal addresses,
+// including after redirects, unless they are allowed
+func TestDownloadSafeMode(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := []byte("\x89PNG\r\n\x1a\nsafe mode test image")
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+	serverURL, _ := url.Parse(server.URL)
+	localhostURL := "http://localhost:" + serverURL.Port()
+
+	downloadDir := th.CreateTestDirectory("safe_mode_downloads")
+	testCases := []struct {
+		name     string
+		policy   downloader.NetworkPolicy
+		url      string
+		category string
+	}{
+		{"loopback refused", downloader.NetworkPolicy{}, server.URL + "/image", downloader.CategoryBlocked},
+		{"allowed range", downloader.NetworkPolicy{AllowNets: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}, server.URL + "/image", ""},
+		{"allowed host", downloader.NetworkPolicy{AllowHosts: []string{"localhost"}}, localhostURL + "/image", ""},
+		{"redirect from allowed host", downloader.NetworkPolicy{AllowHosts: []string{"localhost"}},
+			localhostURL + "/redirect?to=" + url.QueryEscape(server.URL+"/image"), downloader.CategoryBlocked},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := downloader.NewDownloader(5*time.Second, downloader.WithSafeMode(tc.policy))
+			_, err := d.Download(context.Background(), downloader.Request{URL: tc.url, Dir: downloadDir, RowNum: i + 1})
+			if tc.category == "" {
+				if err != nil {
+					t.Errorf("Expected download to succeed, got %v", err)
+				}
+				return
+			}
+			var dErr *downloader.DownloadError
+			if !errors.As(err, &dErr) || dErr.Category != tc.category || dErr.Attempts != 1 {
+				t.Errorf("Expected final %s error, got %v", tc.category, err)
+			}
+		})
+	}
+
+	// A transport safe mode cannot route through its dialer fails closed
+	var called int32
+	custom := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&called, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	d := downloader.NewDownloader(5*time.Second, downloader.WithTransport(custom), downloader.WithSafeMode(downloader.NetworkPolicy{}))
+	_, err := d.Download(context.Background(), downloader.Request{URL: server.URL + "/image", Dir: downloadDir, RowNum: len(testCases) + 1})
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryBlocked || dErr.Attempts != 1 {
+		t.Errorf("Expected final blocked error for an unchecked transport, got %v", err)
+	}
+	if n := atomic.LoadInt32(&called); n != 0 {
+		t.Errorf("Expected the unchecked transport not to be used, got %d requests", n)
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TestDownloadSafeModeIgnoresEnvironmentProxy tests that safe mode does not
+// send requests through HTTP_PROXY unless the proxy is trusted
+func TestDownloadSafeModeIgnoresEnvironmentProxy(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	// The proxy answers every request, so a proxied download would succeed
+	var proxied int32
+	proxy := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nproxied"))
+	}))
+	t.Setenv("HTTP_PROXY", proxy.URL)
+
+	// net/http reads the proxy variables only once per process, so the
+	// transport looks them up itself as ProxyFromEnvironment would
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(*http.Request) (*url.URL, error) {
+		return url.Parse(os.Getenv("HTTP_PROXY"))
+	}
+
+	downloadDir := th.CreateTestDirectory("safe_mode_proxy_downloads")
+	policy := downloader.NetworkPolicy{AllowNets: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	d := downloader.NewDownloader(2*time.Second, downloader.WithTransport(transport), downloader.WithSafeMode(policy))
+	_, err := d.Download(context.Background(), downloader.Request{URL: "http://10.255.255.1/image.png", Dir: downloadDir, RowNum: 1})
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryBlocked {
+		t.Errorf("Expected private target to be blocked despite HTTP_PROXY, got %v", err)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 0 {
+		t.Errorf("Expected no request through the environment proxy, got %d", n)
+	}
+
+	// An explicitly trusted proxy is kept, and only its address is checked
+	policy.TrustProxy = true
+	d = downloader.NewDownloader(2*time.Second, downloader.WithTransport(transport), downloader.WithSafeMode(policy))
+	if _, err := d.Download(context.Background(), downloader.Request{URL: "http://10.255.255.1/image.png", Dir: downloadDir, RowNum: 2}); err != nil {
+		t.Errorf("Expected download through the trusted proxy to succeed, got %v", err)
+	}
+}
+
+// TestDownloadRedirectPolicy tests recording redirect chains and refusing
+// redirects beyond the limit, to other hosts, to plain HTTP or to placeholders
+func TestDownloadRedirectPolicy(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := []byte("\x89PNG\r\n\x1a\nredirect test image")
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/gone":
+			http.Redirect(w, r, "/static/no-image-available.png", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+		}
+	}))
+	tlsServer := httptest.NewTLSServer(http.RedirectHandler(server.URL+"/image.png", http.StatusFound))
+	defer tlsServer.Close()
+	serverURL, _ := url.Parse(server.URL)
+	localhostURL := "http://localhost:" + serverURL.Port()
+
+	downloadDir := th.CreateTestDirectory("redirect_downloads")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithRedirectPolicy(downloader.RedirectPolicy{
+		MaxRedirects: 2,
+		SameHost:     true,
+		NoDowngrade:  true,
+		Placeholders: []*regexp.Regexp{regexp.MustCompile(`no-image`)},
+	}), downloader.WithTransport(tlsServer.Client().Transport))
+
+	res, err := d.Download(context.Background(), downloader.Request{URL: server.URL + "/old", Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("Expected redirected download to succeed, got %v", err)
+	}
+	wantChain := []string{server.URL + "/moved", server.URL + "/image.png"}
+	if strings.Join(res.Redirects, " ") != strings.Join(wantChain, " ") || res.FinalURL != server.URL+"/image.png" {
+		t.Errorf("Expected redirect chain %v ending at %s, got %v and %s", wantChain, wantChain[1], res.Redirects, res.FinalURL)
+	}
+
+	testCases := []struct {
+		name     string
+		url      string
+		category string
+	}{
+		{"placeholder", server.URL + "/gone", downloader.CategoryPlaceholder},
+		{"cross-host", server.URL + "/elsewhere?to=" + url.QueryEscape(localhostURL+"/image.png"), downloader.CategoryRedirect},
+		{"downgrade", tlsServer.URL + "/image.png", downloader.CategoryRedirect},
+		{"too many", server.URL + "/elsewhere?to=" + url.QueryEscape("/old"), downloader.CategoryRedirect},
+	}
+	for i, tc := range testCases {
+		_, err := d.Download(context.Background(), downloader.Request{URL: tc.url, Dir: downloadDir, RowNum: i + 2})
+		var dErr *downloader.DownloadError
+		if !errors.As(err, &dErr) || dErr.Category != tc.category || dErr.Attempts != 1 || len(dErr.Redirects) == 0 {
+			t.Errorf("%s: expected final %s error with its redirect chain, got %v", tc.name, tc.category, err)
+		}
+	}
+
+	// Redirects are not followed at all with a limit of 0
+	d = downloader.NewDownloader(5*time.Second, downloader.WithRedirectPolicy(downloader.RedirectPolicy{}))
+	_, err = d.Download(context.Background(), downloader.Request{URL: server.URL + "/old", Dir: downloadDir, RowNum: 10})
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryRedirect {
+		t.Errorf("Expected redirect error with redirects disabled, got %v", err)
+	}
+}
+
+// TestNormalizeURL tests which URLs --dedupe treats as the same
+func TestNormalizeURL(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		same bool
+	}{
+		{"HTTP://Example.COM/img.png", "http://example.com/img.png", true},
+		{"https://example.com:443/img.png", "https://example.com/img.png", true},
+		{"http://example.com:80/img.png#zoom", "http://example.com/img.png", true},
+		{"http://example.com", "http://example.com/", true},
+		{"http://example.com:8080/img.png", "http://example.com/img.png", false},
+		{"http://example.com/IMG.png", "http://example.com/img.png", false},
+		{"http://example.com/img.png?v=1", "http://example.com/img.png?v=2", false},
+		{"https://example.com/img.png", "http://example.com/img.png", false},
+	}
+	for _, tc := range testCases {
+		if got := utils.NormalizeURL(tc.a) == utils.NormalizeURL(tc.b); got != tc.same {
+			t.Errorf("NormalizeURL(%q) == NormalizeURL(%q) is %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+}
+
+// TestLinkSharedDownload tests saving a row from another row's download as a
+// hard link, symbolic link or copy
+func TestLinkSharedDownload(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	var requests int32
+	image := []byte("\x89PNG\r\n\x1a\nshared image")
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+
+	downloadDir := th.CreateTestDirectory("shared_downloads")
+	d := downloader.NewDownloader(5 * time.Second)
+	first, err := d.Download(context.Background(), downloader.Request{URL: server.URL + "/variant.png", Dir: downloadDir, RowNum: 1})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	modes := []downloader.LinkMode{downloader.LinkHardlink, downloader.LinkSymlink, downloader.LinkCopy}
+	for i, mode := range modes {
+		req := downloader.Request{URL: server.URL + "/variant.png", Dir: downloadDir, RowNum: i + 2, Filename: func(ext string) (string, error) {
+			return filepath.Join(string(mode), "variant"+ext), nil
+		}}
+		res, err := downloader.Link(req, first.Path, mode)
+		if err != nil {
+			t.Fatalf("Link with %s failed: %v", mode, err)
+		}
+		if res.Path != filepath.Join(downloadDir, string(mode), "variant.png") {
+			t.Errorf("Expected %s link at %s/variant.png, got %s", mode, mode, res.Path)
+		}
+		if content, err := os.ReadFile(res.Path); err != nil || !bytes.Equal(content, image) {
+			t.Errorf("Expected %s link to hold the image, got %q, %v", mode, content, err)
+		}
+
+		info, _ := os.Lstat(res.Path)
+		firstInfo, _ := os.Stat(first.Path)
+		switch mode {
+		case downloader.LinkHardlink:
+			if !os.SameFile(info, firstInfo) {
+				t.Errorf("Expected hardlink to share the downloaded file")
+			}
+		case downloader.LinkSymlink:
+			if target, err := os.Readlink(res.Path); err != nil || filepath.IsAbs(target) {
+				t.Errorf("Expected relative symlink, got %q, %v", target, err)
+			}
+		case downloader.LinkCopy:
+			if info.Mode()&os.ModeSymlink != 0 || os.SameFile(info, firstInfo) {
+				t.Errorf("Expected copy to be an independent file")
+			}
+		}
+	}
+
+	if _, err := downloader.ParseLinkMode("reflink"); err == nil {
+		t.Errorf("Expected unknown link mode to be rejected")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected a single request, got %d", n)
+	}
+}
+
+// TestDownloadContentStore tests that identical images share one object and
+// that the manifest maps every row to its hash
+func TestDownloadContentStore(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	logo := []byte("\x89PNG\r\n\x1a\nbrand logo")
+	other := []byte("\x89PNG\r\n\x1a\nproduct shot")
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if strings.HasPrefix(r.URL.Path, "/logo") {
+			w.Write(logo)
+			return
+		}
+		w.Write(other)
+	}))
+
+	downloadDir := th.CreateTestDirectory("content_store")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithContentStore(downloader.LinkHardlink))
+	rep := report.New("test", "in.csv", "url", downloadDir, "")
+	paths := []string{"/logo-a.png", "/logo-b.png", "/product.png"}
+	var results []*downloader.Result
+	for i, p := range paths {
+		res, err := d.Download(context.Background(), downloader.Request{URL: server.URL + p, Dir: downloadDir, RowNum: i + 1})
+		if err != nil {
+			t.Fatalf("Download of %s failed: %v", p, err)
+		}
+		results = append(results, res)
+		rep.Add(report.Row{Row: i + 1, URL: server.URL + p, Status: report.StatusSucceeded, Path: res.Path, SHA256: res.SHA256})
+	}
+
+	logoSum := sha256.Sum256(logo)
+	if results[0].SHA256 != hex.EncodeToString(logoSum[:]) {
+		t.Errorf("Expected SHA-256 %x, got %s", logoSum, results[0].SHA256)
+	}
+	if results[0].Object != downloader.ObjectPath(downloadDir, results[0].SHA256) || results[0].Object != results[1].Object {
+		t.Errorf("Expected identical images to share one object, got %s and %s", results[0].Object, results[1].Object)
+	}
+
+	var objects int
+	filepath.WalkDir(filepath.Join(downloadDir, downloader.ObjectsDir), func(path string, e os.DirEntry, err error) error {
+		if err == nil && !e.IsDir() {
+			objects++
+		}
+		return nil
+	})
+	if objects != 2 {
+		t.Errorf("Expected 2 objects for 3 downloads, found %d", objects)
+	}
+	a, _ := os.Stat(results[0].Path)
+	b, _ := os.Stat(results[1].Path)
+	if !os.SameFile(a, b) {
+		t.Errorf("Expected image_1.png and image_2.png to be links to the same object")
+	}
+
+	// A skipped row recorded without a hash is hashed from its file
+	rep.Add(report.Row{Row: 4, URL: server.URL + "/logo-a.png", Status: report.StatusSkipped, Path: results[0].Path})
+	rep.Add(report.Row{Row: 5, URL: server.URL + "/missing.png", Status: report.StatusFailed})
+	rep.Finish(&csvpkg.ProcessResult{TotalRows: 5})
+	manifestPath := filepath.Join(downloadDir, report.ManifestFileName)
+	if err := rep.WriteManifest(manifestPath, downloadDir); err != nil {
+		t.Fatalf("WriteManifest failed: %v", err)
+	}
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(records) != 5 || strings.Join(records[0], ",") != "row,url,sha256,path" {
+		t.Fatalf("Expected header and 4 rows in manifest, got %v", records)
+	}
+	if records[4][0] != "4" || records[4][2] != results[0].SHA256 || records[4][3] != "image_1.png" {
+		t.Errorf("Expected skipped row 4 to map to %s and image_1.png, got %v", results[0].SHA256, records[4])
+	}
+}
+
+// TestDownloadChecksum tests verifying downloads against expected digests
+func TestDownloadChecksum(t *testing.T) {
+	th := NewTestHelper(t)
+	defer th.Cleanup()
+
+	image := []byte("\x89PNG\r\n\x1a\nchecksum test image")
+	server := th.CreateTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+
+	md5Sum := md5.Sum(image)
+	sha1Sum := sha1.Sum(image)
+	wrong := sha256.Sum256([]byte("a different image"))
+
+	downloadDir := th.CreateTestDirectory("checksum_downloads")
+	d := downloader.NewDownloader(5*time.Second, downloader.WithRetryPolicy(downloader.RetryPolicy{MaxAttempts: 3}))
+	testCases := []struct {
+		name     string
+		checksum downloader.Checksum
+		category string
+		attempts int
+	}{
+		{"md5 match", downloader.Checksum{Algorithm: downloader.ChecksumMD5, Hex: hex.EncodeToString(md5Sum[:])}, "", 1},
+		{"sha1 upper-case match", downloader.Checksum{Algorithm: downloader.ChecksumSHA1, Hex: strings.ToUpper(hex.EncodeToString(sha1Sum[:]))}, "", 1},
+		{"sha256 mismatch", downloader.Checksum{Algorithm: downloader.ChecksumSHA256, Hex: hex.EncodeToString(wrong[:])}, downloader.CategoryChecksum, 1},
+		{"truncated digest", downloader.Checksum{Algorithm: downloader.ChecksumMD5, Hex: "abc123"}, downloader.CategoryBadChecksum, 0},
+	}
+	for i, tc := range testCases {
+		res, err := d.Download(context.Background(), downloader.Request{URL: server.URL + "/image.png", Dir: downloadDir, RowNum: i + 1, Checksum: &tc.checksum})
+		if tc.category == "" {
+			if err != nil {
+				t.Errorf("%s: expected download to succeed, got %v", tc.name, err)
+			} else if res.Attempts != tc.attempts {
+				t.Errorf("%s: expected %d attempt, got %d", tc.name, tc.attempts, res.Attempts)
+			}
+			continue
+		}
+		var dErr *downloader.DownloadError
+		if !errors.As(err, &dErr) || dErr.Category != tc.category || dErr.Attempts != tc.attempts {
+			t.Errorf("%s: expected %s error after %d attempts, got %v", tc.name, tc.category, tc.attempts, err)
+		}
+		if _, err := os.Stat(filepath.Join(downloadDir, fmt.Sprintf("image_%d.png", i+1))); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file to be saved", tc.name)
+		}
+	}
+
+	// Rows linked to a shared download are verified against the shared file
+	_, err := downloader.Link(downloader.Request{Dir: downloadDir, RowNum: 10, Checksum: &downloader.Checksum{
+		Algorithm: downloader.ChecksumSHA256, Hex: hex.EncodeToString(wrong[:]),
+	}}, filepath.Join(downloadDir, "image_1.png"), downloader.LinkCopy)
+	var dErr *downloader.DownloadError
+	if !errors.As(err, &dErr) || dErr.Category != downloader.CategoryChecksum {
+		t.Errorf("Expected checksum mismatch when linking, got %v", err)
+	}
+
+	if algo, err := downloader.ParseChecksumAlgorithm("SHA256"); err != nil || algo != downloader.ChecksumSHA256 {
+		t.Errorf("Expected SHA256 to parse as sha256, got %q, %v", algo, err)
+	}
+	if _, err := downloader.ParseChecksumAlgorithm("crc32"); err == nil {
+		t.Errorf("Expected crc32 to be rejected")
+	}
+}
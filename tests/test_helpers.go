@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
@@ -202,3 +204,101 @@ type MockBehavior struct {
 	Data        string
 	StatusCode  int
 }
+
+// CreateTestFTPServer starts a minimal passive-mode FTP server serving files,
+// keyed by path, to the given user and password. Files under aborted/ are sent
+// in full but the transfer is closed with a 451 reply. It returns the server
+// address.
+func (th *TestHelper) CreateTestFTPServer(user, password string, files map[string][]byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		th.t.Fatalf("Failed to start FTP server: %v", err)
+	}
+	th.cleanupFuncs = append(th.cleanupFuncs, func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTP(conn, user, password, files)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// serveFTP answers the commands of a single FTP control connection
+func serveFTP(conn net.Conn, user, password string, files map[string][]byte) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 test server ready")
+
+	var loginUser string
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(command) {
+		case "USER":
+			loginUser = arg
+			text.PrintfLine("331 password required")
+		case "PASS":
+			if loginUser != user || arg != password {
+				text.PrintfLine("530 login incorrect")
+				continue
+			}
+			text.PrintfLine("230 logged in")
+		case "TYPE":
+			text.PrintfLine("200 type set")
+		case "SIZE":
+			content, ok := files[arg]
+			if !ok {
+				text.PrintfLine("550 no such file")
+				continue
+			}
+			text.PrintfLine("213 %d", len(content))
+		case "EPSV":
+			data, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				text.PrintfLine("425 cannot open data connection")
+				continue
+			}
+			text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "RETR":
+			content, ok := files[arg]
+			if !ok || data == nil {
+				text.PrintfLine("550 no such file")
+				continue
+			}
+			dataConn, err := data.Accept()
+			if err != nil {
+				return
+			}
+			text.PrintfLine("150 opening data connection")
+			dataConn.Write(content)
+			dataConn.Close()
+			if strings.HasPrefix(arg, "aborted/") {
+				text.PrintfLine("451 transfer aborted")
+				continue
+			}
+			text.PrintfLine("226 transfer complete")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 command not implemented")
+		}
+	}
+}